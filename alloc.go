@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"regexp"
+)
+
+var heapDefer = regexp.MustCompile(`(?m):(\d+):(\d+): heap-allocated defer$`)
+
+// heapDefers compiles the program in file and returns the positions of
+// defer statements outside of loops that the compiler nevertheless
+// heap-allocated, which suggests a missed stack or open-coded defer.
+func heapDefers(file string) ([]string, error) {
+	out, err := compileDefers(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	v := &deferVisitor{fset: fset, inLoop: make(map[string]bool)}
+	ast.Walk(v, f)
+
+	var bad []string
+	for _, m := range heapDefer.FindAllStringSubmatch(out, -1) {
+		pos := m[1] + ":" + m[2]
+		if !v.inLoop[pos] {
+			bad = append(bad, pos)
+		}
+	}
+	return bad, nil
+}
+
+// compileDefers compiles the program in file and returns the
+// compiler's report of how it compiled each defer statement.
+func compileDefers(file string) (string, error) {
+	// The last -gcflags for a package wins, so -d=defer overrides
+	// any -gcflags for the program itself.
+	args := append([]string{"build"}, buildFlags()...)
+	out, err := goCommand(append(args, "-gcflags=-d=defer", "-o", os.DevNull, file)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v\n%s", err, out)
+	}
+	return string(out), nil
+}
+
+// A deferVisitor records whether each defer statement, identified by
+// its line and column, is in a loop within its function.
+type deferVisitor struct {
+	fset   *token.FileSet
+	inLoop map[string]bool
+	loop   bool
+}
+
+func (v *deferVisitor) Visit(n ast.Node) ast.Visitor {
+	switch n := n.(type) {
+	case *ast.FuncDecl, *ast.FuncLit:
+		if v.loop {
+			return &deferVisitor{fset: v.fset, inLoop: v.inLoop}
+		}
+	case *ast.ForStmt, *ast.RangeStmt:
+		if !v.loop {
+			return &deferVisitor{fset: v.fset, inLoop: v.inLoop, loop: true}
+		}
+	case *ast.DeferStmt:
+		pos := v.fset.Position(n.Pos())
+		v.inLoop[fmt.Sprintf("%v:%v", pos.Line, pos.Column)] = v.loop
+	}
+	return v
+}
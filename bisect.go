@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// bisect implements "deferfuzz bisect", which finds the first of a
+// list of Go releases that runs a program the same way as the last
+// one, downloading each release with golang.org/dl as needed.
+//
+// To bisect a compiler git checkout instead, use "git bisect run" with
+// a command like "make.bash && deferfuzz -go $GOROOT replay file",
+// which exits with status 1 if the program fails.
+func bisect(args []string) {
+	fs := flag.NewFlagSet("bisect", flag.ExitOnError)
+	versions := fs.String("versions", "", "comma-separated `list` of Go releases to search, oldest first, like go1.20,go1.21.0,go1.22.0")
+	fs.Parse(args)
+	list := strings.Split(*versions, ",")
+	if fs.NArg() != 1 || len(list) < 2 {
+		fatal("usage: deferfuzz bisect -versions v1,v2,... file")
+	}
+	file := fs.Arg(0)
+
+	results := make(map[int]bool) // whether each version fails
+	fails := func(i int) bool {
+		f, ok := results[i]
+		if !ok {
+			*goFlag = toolchain(list[i])
+			_, err := run1(file, buildFlags(), []string{"GOTOOLCHAIN=local"})
+			f = err != nil
+			results[i] = f
+			fmt.Printf("%v: %v\n", list[i], verdict(f))
+		}
+		return f
+	}
+
+	lo, hi := 0, len(list)-1
+	want := fails(hi)
+	if fails(lo) == want {
+		fmt.Printf("%v and %v both %v\n", list[lo], list[hi], verdict(want))
+		return
+	}
+	// Invariant: list[lo] behaves differently than list[hi], and
+	// list[hi] behaves like the last version.
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if fails(mid) == want {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	fmt.Printf("first version that %v: %v (after %v)\n", verdict(want), list[hi], list[lo])
+}
+
+func verdict(fails bool) string {
+	if fails {
+		return "fails"
+	}
+	return "passes"
+}
+
+// toolchain returns the path of the go command for release v,
+// installing and downloading it with golang.org/dl if necessary.
+func toolchain(v string) string {
+	bin, err := goCommand("env", "GOBIN").Output()
+	if err != nil {
+		fatal(err)
+	}
+	dir := strings.TrimSpace(string(bin))
+	if dir == "" {
+		gopath, err := goCommand("env", "GOPATH").Output()
+		if err != nil {
+			fatal(err)
+		}
+		dir = filepath.Join(filepath.SplitList(strings.TrimSpace(string(gopath)))[0], "bin")
+	}
+	path := filepath.Join(dir, v)
+
+	if _, err := os.Stat(path); err != nil {
+		if out, err := goCommand("install", "golang.org/dl/"+v+"@latest").CombinedOutput(); err != nil {
+			fatalf("installing %v: %v\n%s", v, err, out)
+		}
+	}
+	// download does nothing if v was already downloaded.
+	if out, err := exec.Command(path, "download").CombinedOutput(); err != nil {
+		fatalf("downloading %v: %v\n%s", v, err, out)
+	}
+	return path
+}
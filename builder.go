@@ -0,0 +1,60 @@
+package main
+
+// A Builder constructs a Multi one statement at a time, for writing
+// fixed call tree shapes concisely:
+//
+//	B().Step().Defer(B().Recover()).Panic(1).Build()
+//
+// Besides the tests of Run, the generator uses it for the fixed parts
+// of its less common patterns, so it isn't test-only.
+//
+// Units are created with N set to -1, to be numbered by Run, except
+// that a panic's N is the number that Run is expected to give it, for
+// tests, or -1 if it isn't known. Run numbers panics from 1 in the
+// order they're raised.
+type Builder struct {
+	m Multi
+}
+
+// B returns a new, empty Builder.
+func B() *Builder {
+	return new(Builder)
+}
+
+// Build returns the Multi constructed by b.
+func (b *Builder) Build() *Multi {
+	return &b.m
+}
+
+func (b *Builder) Step() *Builder       { return b.Call(&Unit{Kind: Normal, N: -1}) }
+func (b *Builder) Panic(n int) *Builder { return b.Call(&Unit{Kind: Panic, N: n}) }
+func (b *Builder) Recover() *Builder    { return b.Call(&Unit{Kind: Recover, N: -1}) }
+func (b *Builder) Return() *Builder     { return b.Call(&Return{}) }
+
+func (b *Builder) DeferStep() *Builder  { return b.Defer(&Unit{Kind: Normal, N: -1}) }
+func (b *Builder) DeferPanic() *Builder { return b.Defer(&Unit{Kind: Panic, N: -1}) }
+
+// Call appends a call of c, which is a *Builder or a call tree node.
+func (b *Builder) Call(c interface{}) *Builder {
+	return b.stmt(false, c)
+}
+
+// Defer appends a deferred call of c, which is a *Builder or a call
+// tree node.
+func (b *Builder) Defer(c interface{}) *Builder {
+	return b.stmt(true, c)
+}
+
+// Append appends the statements of m.
+func (b *Builder) Append(m *Multi) *Builder {
+	b.m.Body = append(b.m.Body, m.Body...)
+	return b
+}
+
+func (b *Builder) stmt(Defer bool, c interface{}) *Builder {
+	if c, ok := c.(*Builder); ok {
+		return b.stmt(Defer, c.Build())
+	}
+	b.m.Body = append(b.m.Body, &Stmt{Defer: Defer, Call: c})
+	return b
+}
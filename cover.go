@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cover implements "deferfuzz cover", which steers generation toward
+// programs that exercise new code in the compiler.
+//
+// It compiles each program with a compiler built with coverage
+// instrumentation, like
+//
+//	go build -cover -coverpkg=cmd/compile,cmd/compile/internal/... -o compile.cover cmd/compile
+//
+// and keeps the decision logs of the programs that cover new blocks of
+// the packages it watches in the corpus. Each later program is
+// generated from a mutant of a log in the corpus, or occasionally from
+// scratch, and is also run and checked like any other.
+//
+// The -seed, -n, and -duration flags apply as for run.
+func cover(args []string) {
+	fs := flag.NewFlagSet("cover", flag.ExitOnError)
+	compiler := fs.String("compiler", "", "compile programs with the coverage-instrumented compiler `file`")
+	pkgs := fs.String("pkg", "cmd/compile/internal/ssagen,cmd/compile/internal/walk,cmd/compile/internal/escape", "watch the coverage of the compiler packages matching comma-separated `patterns`")
+	corpus := fs.String("corpus", "corpus", "save the decision logs that reach new coverage, and failing programs, in `dir`")
+	fs.Parse(args)
+	if *compiler == "" || fs.NArg() > 0 {
+		fatal("usage: deferfuzz cover -compiler file [-pkg patterns] [-corpus dir]")
+	}
+	if err := os.MkdirAll(*corpus, 0777); err != nil {
+		fatal(err)
+	}
+	work, cleanup := workDir()
+	defer cleanup()
+	if err := writeImportcfg(work); err != nil {
+		fatal(err)
+	}
+
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+	covered := make(map[string]bool)
+	var logs [][]int
+	failed := 0
+	begin := time.Now()
+	var lastProgress time.Time
+	for i := 0; (*iters == 0 || i < *iters) && (*duration == 0 || time.Since(begin) < *duration); i++ {
+		log := mutate(r, logs)
+		name := filepath.Join(*corpus, fmt.Sprintf("%06d.txt", i))
+		if err := writeLog(name, log); err != nil {
+			fatal(err)
+		}
+		m := build(&playback{log: log})
+		buf, err := program(m, fmt.Sprintf("Generated by %q.", decisionsCommand(name)))
+		if err != nil {
+			fatal(err)
+		}
+		file := filepath.Join(work, "test.go")
+		if err := ioutil.WriteFile(file, buf, 0666); err != nil {
+			fatal(err)
+		}
+
+		blocks, err := compilerCoverage(*compiler, *pkgs, file, work)
+		var out []byte
+		if err == nil {
+			if out, err = run(file); err == nil {
+				err = checkExit(m, out)
+			}
+		}
+		if err != nil {
+			failed++
+			prog := strings.TrimSuffix(name, ".txt") + ".go"
+			if err := ioutil.WriteFile(prog, buf, 0666); err != nil {
+				fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "FAIL (%v): %v: %v\n", classify(out, err), prog, err)
+			if e := explanation(out); e != "" {
+				fmt.Fprintf(os.Stderr, "\t%v\n", e)
+			}
+			continue
+		}
+
+		added := 0
+		for _, b := range blocks {
+			if !covered[b] {
+				covered[b] = true
+				added++
+			}
+		}
+		if added == 0 {
+			os.Remove(name)
+		} else {
+			logs = append(logs, log)
+			if !*quiet {
+				fmt.Printf("%v: %v new blocks, %v in all; corpus of %v\n", i, added, len(covered), len(logs))
+			}
+		}
+		if !*quiet && time.Since(lastProgress) >= *progress {
+			fmt.Printf("%v (seed %v)\n", i, seed)
+			lastProgress = time.Now()
+		}
+	}
+
+	fmt.Printf("covered %v blocks with a corpus of %v decision logs in %v (seed %v)\n", len(covered), len(logs), *corpus, seed)
+	if failed > 0 {
+		fmt.Printf("%v programs failed\n", failed)
+		os.Exit(exitFailed)
+	}
+}
+
+// mutate returns the decision log for the next program: a mutant of a
+// log in corpus, or one recorded from scratch.
+func mutate(r *rand.Rand, corpus [][]int) []int {
+	if len(corpus) == 0 || r.Intn(4) == 0 {
+		rec := &recorder{r: rand.New(rand.NewSource(r.Int63()))}
+		build(rec)
+		return rec.log
+	}
+	log := append([]int(nil), corpus[r.Intn(len(corpus))]...)
+	if len(log) == 0 {
+		return log
+	}
+	// playback wraps decisions around and makes the missing ones 0,
+	// so any change to a log is still a valid log.
+	i := r.Intn(len(log))
+	switch r.Intn(3) {
+	case 0:
+		log[i] = r.Intn(1 << 16)
+	case 1:
+		log = log[:i]
+	case 2:
+		other := corpus[r.Intn(len(corpus))]
+		log = append(log[:i], other[r.Intn(len(other)+1):]...)
+	}
+	return log
+}
+
+// compilerCoverage compiles the program in file with the coverage
+// instrumented compiler, and returns the blocks of the packages
+// matching pkgs that it executed. It writes the coverage data in dir.
+//
+// Only the compiler failing is an error; failing to collect its
+// coverage is a problem with the environment, not the program.
+func compilerCoverage(compiler, pkgs, file, dir string) ([]string, error) {
+	covdir := filepath.Join(dir, "covdata")
+	os.RemoveAll(covdir)
+	if err := os.Mkdir(covdir, 0777); err != nil {
+		fatal(err)
+	}
+	cmd := exec.Command(compiler, "-p", "main", "-importcfg", importcfg, "-o", file+".o", file)
+	cmd.Env = append(os.Environ(), "GOCOVERDIR="+covdir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("compile: %v\n%s", err, out)
+	}
+
+	text := filepath.Join(dir, "cover.txt")
+	if out, err := goCommand("tool", "covdata", "textfmt", "-i", covdir, "-pkg", pkgs, "-o", text).CombinedOutput(); err != nil {
+		fatalf("covdata: %v\n%s", err, out)
+	}
+	data, err := ioutil.ReadFile(text)
+	if err != nil {
+		fatal(err)
+	}
+	// Each line is "file:start,end statements count".
+	var blocks []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[2] != "0" {
+			blocks = append(blocks, f[0])
+		}
+	}
+	if len(blocks) == 0 {
+		fatalf("%v covered none of %v; was it built with -cover and a -coverpkg including cmd/compile?", compiler, pkgs)
+	}
+	return blocks, nil
+}
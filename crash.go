@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// classes lists the kinds of failures returned by classify.
+var classes = []string{"build", "ice", "runtime", "mismatch", "timeout", "exit", "check"}
+
+// errTimeout is the error for a program that ran too long.
+var errTimeout = errors.New("timed out")
+
+var logLine = regexp.MustCompile(`(?m)^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d `)
+
+// classify returns the kind of a failure with output out and error err:
+//
+//	build     the program didn't build
+//	ice       the compiler crashed
+//	runtime   the program crashed, with a throw or an unrecovered panic
+//	mismatch  the program's checks failed, so the oracle disagrees
+//	timeout   the program ran too long
+//	exit      the program exited unsuccessfully without explanation
+//	check     another check failed, like -compare-inlined
+func classify(out []byte, err error) string {
+	msg := string(out) + err.Error()
+	var exit *exec.ExitError
+	switch {
+	case strings.Contains(msg, "internal compiler error"):
+		return "ice"
+	case bytes.HasPrefix(out, []byte("# ")):
+		return "build"
+	case errors.Is(err, errTimeout):
+		return "timeout"
+	case strings.Contains(msg, "fatal error: "), strings.Contains(msg, "\npanic: "), strings.HasPrefix(msg, "panic: "):
+		return "runtime"
+	case logLine.Match(out):
+		return "mismatch"
+	case errors.As(err, &exit):
+		return "exit"
+	}
+	return "check"
+}
+
+// crashSignature returns a signature identifying the cause of the
+// failing program r, for deduplicating failures.
+func crashSignature(r *result) string {
+	return r.class + ": " + normalize(r.err.Error()) + ": " + signature(r.out)
+}
+
+// A bucket is a group of failures with the same signature.
+type bucket struct {
+	sig  string
+	dir  string
+	n    int       // number of failures
+	kept []*result // saved failures, at most -bucket-cap
+}
+
+// A triage sorts failures into buckets.
+type triage struct {
+	n       int // number of failures
+	saved   int // number of programs saved, in all buckets
+	buckets map[string]*bucket
+	order   []*bucket // in order of first failure
+}
+
+// add adds the failing program r to its bucket, and reports whether
+// it was saved. Each bucket keeps the smallest -bucket-cap programs,
+// saved by saveCrash in the bucket's directory, and at most
+// -max-artifacts programs are kept in all.
+func (t *triage) add(r *result) bool {
+	t.n++
+	sig := crashSignature(r)
+	b := t.buckets[sig]
+	if b == nil {
+		if t.buckets == nil {
+			t.buckets = make(map[string]*bucket)
+		}
+		b = &bucket{sig: sig, dir: filepath.Join(*crashDir, r.class, fmt.Sprintf("%x", sha1.Sum([]byte(sig)))[:8])}
+		t.buckets[sig] = b
+		t.order = append(t.order, b)
+		if err := os.MkdirAll(b.dir, 0777); err != nil {
+			fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(b.dir, "signature.txt"), []byte(sig+"\n"), 0666); err != nil {
+			fatal(err)
+		}
+	}
+	b.n++
+	if *bucketCap <= 0 {
+		return false
+	}
+
+	if len(b.kept) >= *bucketCap {
+		if len(r.src) >= len(b.largest().src) {
+			return false
+		}
+		t.remove(b)
+	}
+	if *artifactCap > 0 && t.saved >= *artifactCap && !t.evict(b, r) {
+		return false
+	}
+
+	// Keep the program, which the worker will overwrite.
+	dir, err := saveCrash(r, b.dir)
+	if err != nil {
+		fatal(err)
+	}
+	r.file = filepath.Join(dir, "prog.go")
+	if *rerunModes && r.inlined == nil {
+		r.modes = rerun(r.file)
+		ioutil.WriteFile(filepath.Join(dir, "modes.txt"), []byte(strings.Join(r.modes, "\n")+"\n"), 0666)
+	}
+	if *autoMin {
+		minimizeCrash(r, dir)
+	}
+	b.kept = append(b.kept, r)
+	t.saved++
+	if b.n == 1 && *onFailure != "" {
+		runHook(dir)
+	}
+	return true
+}
+
+// largest returns the largest program kept in b, which keeps some.
+func (b *bucket) largest() *result {
+	largest := b.kept[0]
+	for _, k := range b.kept {
+		if len(k.src) > len(largest.src) {
+			largest = k
+		}
+	}
+	return largest
+}
+
+// remove removes the largest program kept in b.
+func (t *triage) remove(b *bucket) {
+	largest := b.largest()
+	for i, k := range b.kept {
+		if k == largest {
+			b.kept = append(b.kept[:i], b.kept[i+1:]...)
+			break
+		}
+	}
+	os.RemoveAll(filepath.Dir(largest.file))
+	t.saved--
+}
+
+// evict makes room for the failing program r in bucket b, when
+// -max-artifacts programs are already saved, and reports whether it
+// did. To keep programs that fail in as many ways as possible, it
+// removes the largest program of the bucket that keeps the most, but
+// never the only program of a bucket.
+func (t *triage) evict(b *bucket, r *result) bool {
+	var victim *bucket
+	for _, c := range t.order {
+		if len(c.kept) > 1 && (victim == nil || len(c.kept) > len(victim.kept) ||
+			len(c.kept) == len(victim.kept) && len(c.largest().src) > len(victim.largest().src)) {
+			victim = c
+		}
+	}
+	if victim == nil || victim == b && len(r.src) >= len(b.largest().src) {
+		return false
+	}
+	t.remove(victim)
+	return true
+}
+
+// runHook runs the -on-failure command for the new failure saved in
+// dir. The hook's own failures are reported but otherwise ignored.
+func runHook(dir string) {
+	args := append(strings.Fields(*onFailure), dir)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "-on-failure %v: %v\n", dir, err)
+	}
+}
+
+// report reports the smallest failing program in each bucket, and
+// summarizes the buckets by class.
+func (t *triage) report(ran int) {
+	byClass := make(map[string]int)
+	for _, b := range t.order {
+		if len(b.kept) == 0 {
+			fmt.Fprintf(os.Stderr, "\n%v programs failed with signature %q; none were saved\n", b.n, b.sig)
+			byClass[strings.SplitN(b.sig, ":", 2)[0]]++
+			continue
+		}
+		smallest := b.kept[0]
+		for _, k := range b.kept {
+			if len(k.src) < len(smallest.src) {
+				smallest = k
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+		report(smallest)
+		if b.n > 1 {
+			fmt.Fprintf(os.Stderr, "%v more programs failed the same way; the smallest %v are in %v\n", b.n-1, len(b.kept), b.dir)
+		}
+		byClass[smallest.class]++
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%v of %v programs failed, in %v distinct ways:\n", t.n, ran, len(t.order))
+	for _, class := range classes {
+		if n := byClass[class]; n > 0 {
+			fmt.Fprintf(os.Stderr, "  %-10v %v\n", class, n)
+		}
+	}
+}
+
+// saveCrash saves everything known about the failing program r in a
+// new directory in dir, and returns the new directory.
+func saveCrash(r *result, dir string) (string, error) {
+	dir = filepath.Join(dir, fmt.Sprint(r.seed))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+
+	var info bytes.Buffer
+	fmt.Fprintf(&info, "seed: %v\n", r.seed)
+	fmt.Fprintf(&info, "error: %v\n", r.err)
+	fmt.Fprintf(&info, "class: %v\n", r.class)
+	fmt.Fprintf(&info, "signature: %v\n", crashSignature(r))
+	if v, err := goVersion(); err == nil {
+		fmt.Fprintf(&info, "toolchain: %v\n", v)
+	}
+	fmt.Fprintf(&info, "flags: %v\n", strings.Join(os.Args[1:], " "))
+	fmt.Fprintf(&info, "replay: %v\n", command(r.seed))
+	fmt.Fprintf(&info, "replay decisions: deferfuzz replay -decisions %v\n", filepath.Join(dir, "decisions.txt"))
+
+	var tree bytes.Buffer
+	DumpTree(&tree, r.m)
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"prog.go", reproducer(r, r.src)},
+		{"output.txt", r.out},
+		{"info.txt", info.Bytes()},
+		{"tree.txt", tree.Bytes()},
+	}
+	if r.inlined != nil {
+		files = append(files, []struct {
+			name string
+			data []byte
+		}{
+			{"prog_inl.go", reproducer(r, r.inlined)},
+			{"output_inl.txt", r.outInlined},
+		}...)
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), f.data, 0666); err != nil {
+			return "", err
+		}
+	}
+	if err := writeDecisions(filepath.Join(dir, "decisions.txt"), r.seed); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// minimizeCrash shrinks the failing program r, saving the result in
+// the crash directory dir as min.go, and as min_inl.go too if it
+// failed only with inlining allowed.
+func minimizeCrash(r *result, dir string) {
+	file := filepath.Join(dir, "min.go")
+	m, buf := generate(r.seed)
+	fails := failsWith(file, signature(r.out))
+	if r.inlined != nil {
+		fails = failsInlined(file, inlinedSignature(r.outInlined, r.err))
+	}
+	if !fails(buf) {
+		fmt.Fprintf(os.Stderr, "seed %v: not minimizing failure that running the program alone doesn't reproduce\n", r.seed)
+		os.Remove(file)
+		os.Remove(inlinedFile(file))
+		return
+	}
+	shrink(m, command(r.seed), fails)
+}
+
+// reproducer returns src, the failing program r or its inlined
+// variant, with a header describing how it was generated and built,
+// and how it failed, so that it can be reported on its own.
+func reproducer(r *result, src []byte) []byte {
+	var buf bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintln(&buf, strings.TrimSpace("// "+fmt.Sprintf(format, args...)))
+	}
+	line("This program failed when built and run by deferfuzz.")
+	line("")
+	line("Seed: %v", r.seed)
+	line("Regenerate with: %v", command(r.seed))
+	if v, err := goVersion(); err == nil {
+		line("Toolchain: %v", v)
+	}
+	if flags := buildFlags(); len(flags) > 0 {
+		line("Build flags: %v", strings.Join(flags, " "))
+	}
+	if len(experiments) > 0 {
+		line("GOEXPERIMENT settings: %q", []string(experiments))
+	}
+	if *inline || r.inlined != nil && bytes.Equal(src, r.inlined) {
+		line("Inlining: allowed")
+	}
+	line("")
+	line("Observed: %v: %v", r.class, r.err)
+	if e := explanation(r.out); e != "" {
+		line("  %v", e)
+	}
+
+	steps, recovers := 0, []string(nil)
+	for _, e := range (Sim{}).Events(r.m) {
+		if strings.HasPrefix(e, "step ") {
+			steps++
+		} else {
+			recovers = append(recovers, strings.TrimPrefix(e, "recover "))
+		}
+	}
+	line("Expected: %v steps, recovers returning panics %v (0 means nil), and exit status 0", steps, recovers)
+	fmt.Fprintln(&buf)
+
+	buf.Write(src)
+	return buf.Bytes()
+}
+
+// modes lists alternate ways to compile a failing program, to help
+// localize the bug: in the optimizer, in inlining, or in open-coded
+// defers, which -d=noopendefer disables while still optimizing.
+var modes = []struct{ name, gcflags string }{
+	{"optimized", ""},
+	{"no inlining", "all=-l"},
+	{"no open-coded defers", "all=-d=noopendefer"},
+	{"no optimization", "all=-N -l"},
+}
+
+// rerun reruns the program in file under each of modes, ignoring
+// -gcflags, and returns a description of which reproduce the failure.
+func rerun(file string) []string {
+	var results []string
+	for _, mode := range modes {
+		var flags []string
+		if mode.gcflags != "" {
+			flags = append(flags, "-gcflags="+mode.gcflags)
+		}
+		if *ldflags != "" {
+			flags = append(flags, "-ldflags="+*ldflags)
+		}
+		verdict := "passes"
+		if _, err := run1(file, flags, nil); err != nil {
+			verdict = "fails"
+		}
+		results = append(results, fmt.Sprintf("%v (-gcflags=%q): %v", mode.name, mode.gcflags, verdict))
+	}
+	return results
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// A decider makes the random decisions that shape a call tree.
+// Every decision is a choice of a number in [0, n).
+type decider interface {
+	Intn(n int) int
+}
+
+// A recorder is a decider that records its decisions.
+type recorder struct {
+	r   *rand.Rand
+	log []int
+}
+
+func (r *recorder) Intn(n int) int {
+	v := r.r.Intn(n)
+	r.log = append(r.log, v)
+	return v
+}
+
+// A playback is a decider that repeats recorded decisions.
+//
+// Unlike a seed, a decision log still produces a similar call tree
+// after the generator changes: a recorded decision that's now out of
+// range is wrapped around, and once the log runs out, every decision
+// is 0, which chooses the first alternative.
+type playback struct {
+	log []int
+}
+
+func (p *playback) Intn(n int) int {
+	if len(p.log) == 0 {
+		return 0
+	}
+	v := p.log[0] % n
+	p.log = p.log[1:]
+	return v
+}
+
+// decisionsHeader starts a decision log, followed by the generation
+// flags and then one decision per line.
+const decisionsHeader = "# deferfuzz decisions:"
+
+// writeDecisions writes the decisions made generating the call tree
+// for seed to file.
+func writeDecisions(file string, seed int64) error {
+	rec := &recorder{r: rand.New(rand.NewSource(seed))}
+	build(rec)
+	return writeLog(file, rec.log)
+}
+
+// writeLog writes the decision log log to file.
+func writeLog(file string, log []int) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v %v\n", decisionsHeader, strings.TrimSpace(genArgs()))
+	for _, v := range log {
+		fmt.Fprintln(&buf, v)
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0666)
+}
+
+// readDecisions reads a decision log written by writeDecisions, and
+// sets the generation flags recorded in it.
+func readDecisions(file string) []int {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fatal(err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	if !sc.Scan() || !strings.HasPrefix(sc.Text(), decisionsHeader) {
+		fatalf("%v: not a decision log", file)
+	}
+	if err := flag.CommandLine.Parse(strings.Fields(strings.TrimPrefix(sc.Text(), decisionsHeader))); err != nil {
+		fatal(err)
+	}
+	var log []int
+	for sc.Scan() {
+		v, err := strconv.Atoi(sc.Text())
+		if err != nil {
+			fatalf("%v: %v", file, err)
+		}
+		log = append(log, v)
+	}
+	return log
+}
+
+// regenerate returns the call tree and program for the decision log
+// in file.
+func regenerate(file string) (*Multi, []byte) {
+	m := build(&playback{log: readDecisions(file)})
+	buf, err := program(m, fmt.Sprintf("Generated by %q.", decisionsCommand(file)))
+	if err != nil {
+		fatal(err)
+	}
+	return m, buf
+}
+
+// decisionsCommand returns the deferfuzz command that regenerates the
+// program for the decision log in file.
+func decisionsCommand(file string) string {
+	return "deferfuzz " + genArgs() + "replay -decisions " + file
+}
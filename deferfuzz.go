@@ -2,14 +2,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"go/format"
 	"io"
-	"io/ioutil"
-	"log"
 	"math/rand"
-	"os/exec"
-	"time"
+	"strings"
+	"sync"
 )
 
 // Fuzzer design notes:
@@ -53,104 +53,693 @@ import (
 //
 // I think "func main()" should always start with "defer func() { recover() }()".
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
+// generate returns a random call tree and the program for it.
+//
+// The call tree depends only on seed and the flags in genFlags.
+// Constructs that need a newer language version are still generated,
+// and then dropped, so that -lang doesn't perturb the rest of the
+// tree. Options that change the program, like -inline, must be
+// applied afterwards rather than consulted during generation.
+func generate(seed int64) (*Multi, []byte) {
+	m := build(rand.New(rand.NewSource(seed)))
+	buf, err := program(m, fmt.Sprintf("Generated by %q.", command(seed)))
+	if err != nil {
+		fatal(err)
+	}
+	return m, buf
+}
 
-	for i := 0; ; i++ {
-		fmt.Println(i)
+// build returns a random call tree, making each random decision with d.
+func build(d decider) *Multi {
+	m := B().Defer(B().Recover()).Build()
 
-		buf := generate()
-		ioutil.WriteFile("test.go", buf, 0666)
-		if err := exec.Command("go", "run", "test.go").Run(); err != nil {
-			log.Fatal("hm?", err)
+	f := Fuzzer{rand: d, w: weights(), maxDepth: *maxDepth, lang: langMinor(*lang)}
+	lo, hi := budgetRange(*budget)
+	f.budget = lo
+	if hi > lo {
+		f.budget += f.rand.Intn(hi - lo + 1)
+	}
+	for n := f.rand.Intn(3); n > 0; n-- {
+		m.Body = append(m.Body, &Stmt{Call: &Init{Body: B().Defer(B().Recover()).Append(f.sub()).Build()}})
+	}
+	f.Fill(m)
+	if *osExit {
+		f.insert(m, &Exit{N: -1})
+	}
+	if *crashGo {
+		c := &Crash{Body: B().Build(), Panic: &Unit{Kind: Panic, N: -1}}
+		for n := f.rand.Intn(4); n > 0; n-- {
+			if f.rand.Intn(2) == 0 {
+				c.Body = B().Append(c.Body).DeferStep().Build()
+			} else {
+				c.Body = B().Append(c.Body).Step().Build()
+			}
 		}
+		f.insert(m, c)
 	}
+	return m
 }
 
-func generate() []byte {
-	steps, panics = 0, 0
+// genFlags lists the flags that affect the generated call tree.
+var genFlags = []string{"budget", "weights", "p-defer", "p-nest", "p-recover", "p-panic", "max-depth", "lang", "os-exit", "crash-goroutine", "bulk-defers"}
 
-	var m Multi
-	m.Body = []*Stmt{{Defer: true, Call: &Multi{Body: []*Stmt{{Call: &Unit{Kind: Recover}}}}}}
+// command returns the deferfuzz command that regenerates the program
+// for seed with the current generation options.
+func command(seed int64) string {
+	return fmt.Sprintf("deferfuzz %vreplay %v", genArgs(), seed)
+}
+
+// genArgs returns the flags in genFlags that differ from their
+// defaults, formatted as command-line arguments followed by a space.
+// Boolean flags are formatted as -name=value, since a separate value
+// would end the flags.
+func genArgs() string {
+	var args string
+	for _, name := range genFlags {
+		f := flag.Lookup(name)
+		if f.Value.String() == f.DefValue {
+			continue
+		}
+		if isBoolFlag(f) {
+			args += fmt.Sprintf("-%v=%v ", name, f.Value)
+		} else {
+			args += fmt.Sprintf("-%v %v ", name, f.Value)
+		}
+	}
+	return args
+}
 
-	f := Fuzzer{budget: 100}
-	f.Fill(&m)
+// isBoolFlag reports whether f is a boolean flag, which may be given
+// without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
 
-	var a int
-	b := Run(&m, &a)
-	if a != 0 || b != 0 {
-		log.Fatalf("huh? %v %v", a, b)
+// program simulates m and returns the program for it, starting with
+// comment. It returns an error if a panic escapes m.
+func program(m *Multi, comment string) ([]byte, error) {
+	simMu.Lock()
+	defer simMu.Unlock()
+	steps, panics, events = 0, 0, nil
+	panicBoxes = make(map[int]string)
+	if a, b := simulate(m); a != 0 || b != 0 {
+		return nil, fmt.Errorf("huh? %v %v", a, b)
 	}
 
-	var buf bytes.Buffer
-	fmt.Fprintln(&buf, "package main; import `log`; func main() {")
-	Write(&buf, &m)
+	var buf, decls bytes.Buffer
+	if *lang != "" {
+		fmt.Fprintf(&buf, "//go:build go1.%v\n\n", langMinor(*lang))
+	}
+	fmt.Fprintf(&buf, "// %v\n\n", comment)
+	fmt.Fprintln(&buf, "package main; import (`log`; `os`; `runtime`; `strings`; `sync`); func main() {")
+	Write(&buf, &decls, m)
 	fmt.Fprintln(&buf, "}")
-	fmt.Fprintln(&buf, `
+	buf.Write(decls.Bytes())
+	buf.WriteString(support)
+
+	return format.Source(buf.Bytes())
+}
+
+// budgetRange parses -budget, which is either a single budget like
+// "100" or a range like "10-1000".
+func budgetRange(s string) (lo, hi int) {
+	if n, err := fmt.Sscanf(s, "%d-%d", &lo, &hi); n == 1 {
+		hi = lo
+	} else if err != nil || lo > hi {
+		fatalf("bad budget %q", s)
+	}
+	if lo < 0 {
+		fatalf("bad budget %q", s)
+	}
+	return lo, hi
+}
+
+// langMinor returns the minor version of Go language version v,
+// like "go1.23", or 0 if v is empty.
+func langMinor(v string) int {
+	if v == "" {
+		return 0
+	}
+	var n int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(v, "go"), "1.%d", &n); err != nil {
+		fatalf("bad language version %q", v)
+	}
+	return n
+}
 
-func expect(n int, err interface{}) {
+// support is the runtime support code for generated programs.
+const support = `
+func expect(n int, err interface{}, where string) {
 	println("expect", n)
+	err = id(err)
 	if n != err && !(n == 0 && err == nil) {
-		log.Fatalf("have %v, want %v", err, n)
+		log.Fatalf("recover: have %v, want %v (%v)", err, n, where)
+	}
+}
+
+func chanval(n int) chan int    { return make(chan int, n) }
+func mapval(n int) map[int]int { return map[int]int{0: n} }
+func strval(n int) string      { return strings.Repeat("s", n) }
+func pairval(n int) pair       { return pair{n, -n} }
+func ptrval(n int) *int        { return &n }
+func ifaceval(n int) error     { return &errptr{n} }
+
+type errval int
+
+func (errval) Error() string { return "errval" }
+
+type pair struct{ a, b int }
+
+type errptr struct{ n int }
+
+func (*errptr) Error() string { return "errptr" }
+
+// id returns the int identifying a panic value made by one of the
+// functions above, or by errval, which can't be compared directly.
+func id(v interface{}) interface{} {
+	switch v := v.(type) {
+	case chan int:
+		return cap(v)
+	case map[int]int:
+		return v[0]
+	case errval:
+		return int(v)
+	case string:
+		return len(v)
+	case pair:
+		return v.a
+	case *int:
+		return *v
+	case *errptr:
+		return v.n
+	}
+	return v
+}
+
+// boxof returns the name of the function that made the panic value v.
+func boxof(v interface{}) string {
+	switch v.(type) {
+	case chan int:
+		return "chanval"
+	case map[int]int:
+		return "mapval"
+	case errval:
+		return "errval"
+	case string:
+		return "strval"
+	case pair:
+		return "pairval"
+	case *int:
+		return "ptrval"
+	case *errptr:
+		return "ifaceval"
+	}
+	return ""
+}
+
+// expectbox is like expect, but also checks that the panic value v
+// was made by box.
+func expectbox(n int, box string, v interface{}, where string) {
+	if v != nil && boxof(v) != box {
+		log.Fatalf("recover: have %T, want %v(%v) (%v)", v, box, n, where)
+	}
+	expect(n, v, where)
+}
+
+func expecterr(n int, err error) {
+	println("expecterr", n)
+	if id(err) != n {
+		log.Fatalf("have %v, want errval(%v)", err, n)
+	}
+}
+
+// expectassert calls f and checks that it panics with a runtime
+// error from a failed type assertion.
+func expectassert(f func() error) {
+	println("expectassert")
+	defer func() {
+		if _, ok := recover().(*runtime.TypeAssertionError); !ok {
+			log.Fatal("missing type assertion panic")
+		}
+	}()
+	f()
+}
+
+// expectnil checks that v, a recovered panic, is the run-time error
+// from calling a nil function, and then panics with n.
+func expectnil(v interface{}, n int) {
+	println("expectnil", n)
+	if _, ok := v.(runtime.Error); !ok {
+		log.Fatalf("have %v, want nil function call panic", v)
+	}
+	panic(n)
+}
+
+// recoverhelper calls recover, which returns nil because it isn't
+// called directly by a deferred function.
+func recoverhelper() interface{} {
+	type _ int
+	return recover()
+}
+
+// expectfault checks that v, a recovered panic, is a run-time error
+// whose message contains msg, and then panics with n.
+func expectfault(v interface{}, msg string, n int) {
+	println("expectfault", n)
+	if e, ok := v.(runtime.Error); !ok || !strings.Contains(e.Error(), msg) {
+		log.Fatalf("recover: have %v, want run-time error %q", v, msg)
+	}
+	panic(n)
+}
+
+// Operands for run-time panics, in variables so that the compiler
+// can't detect the panics.
+var (
+	nilptr *int
+	zero   int
+	small  []int
+	nilmap map[int]int
+	iface  interface{} = "iface"
+)
+
+// exit checks that want steps have happened, and exits successfully
+// without running any deferred calls.
+func exit(want int) {
+	println("exit", want)
+	if steps != want {
+		log.Fatalf("exit: have %v steps, want %v", steps, want)
+	}
+	os.Exit(0)
+}
+
+// crashed announces that the program is about to crash with panic n,
+// after want steps.
+func crashed(n, want int) {
+	println("crash", n)
+	if steps != want {
+		log.Fatalf("crash: have %v steps, want %v", steps, want)
+	}
+}
+
+func expectret(want, have int) {
+	println("expectret", want)
+	if have != want {
+		log.Fatalf("have %v, want %v", have, want)
+	}
+}
+
+type T struct{ n int }
+
+func (t T) V(n, want int) {
+	type _ int
+	step(n, "value receiver")
+	expectret(want, t.n)
+}
+
+func (t *T) P(n, want int) {
+	type _ int
+	step(n, "pointer receiver")
+	expectret(want, t.n)
+}
+
+type Ver interface{ V(n, want int) }
+type Per interface{ P(n, want int) }
+
+// suppress reports whether a filtering recover should suppress,
+// rather than propagate, the panic with value v.
+func suppress(v interface{}) bool {
+	n, _ := id(v).(int)
+	return n%2 == 0
+}
+
+// arg steps and returns n, for use as a call argument.
+func arg(n int) int {
+	step(n, "argument")
+	return n
+}
+
+// step3 steps after checking that its arguments came from
+// consecutive calls to arg.
+func step3(n, a, b, c int) {
+	if b != a+1 || c != b+1 {
+		log.Fatalf("step %v: have arguments %v, %v, %v", n, a, b, c)
 	}
+	step(n, "call with arguments")
 }
 
-var steps int
+var g, steps int
+
+// block is never ready to communicate.
+var block chan int
+
+// Only some programs wait for goroutines with a sync.WaitGroup.
+var _ sync.WaitGroup
+
+// level is the level of recursion of the r functions.
+var level int
+
+// closed is always ready to communicate, even in init functions.
+var closed = func() chan int {
+	c := make(chan int)
+	close(c)
+	return c
+}()
+
+// ints and values are variables so that the compiler can't tell which
+// arm of a switch on their elements is taken.
+var (
+	ints   = [...]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	values = [...]interface{}{0, "s", pair{}, errval(0), nil}
+)
+
+// panicnil reports whether panic(nil) is recovered as nil, rather
+// than as a *runtime.PanicNilError, as before Go 1.21.
+var panicnil = strings.Contains(os.Getenv("GODEBUG"), "panicnil=1")
+
+// yes and no are variables so that the compiler can't tell which
+// branch of an if statement is taken.
+var yes, no = true, false
 
-func step(want int) {
+func step(want int, where string) {
 	println("step", want)
 	steps++
 	if steps != want {
-		log.Fatalf("have %v, want %v", steps, want)
+		log.Fatalf("step %v: have %v, want %v (%v)", want, steps, want, where)
 	}
 }
-`)
+`
 
-	out, err := format.Source(buf.Bytes())
-	if err != nil {
-		log.Fatal(err)
+// simMu guards the simulation state used by Run.
+var simMu sync.Mutex
+
+var steps, panics int
+
+// panicBoxes records the Box of each panic simulated by Run.
+var panicBoxes = make(map[int]string)
+
+// events records the steps and recovers simulated by Run.
+var events []string
+
+// errExit stops Run at a call of os.Exit, or a crash.
+var errExit = errors.New("exit")
+
+// simulate runs m with Run, as main, and returns the panic recovered
+// by main's deferred recover and the panic that escapes main, if any.
+// Both are 0 if m calls os.Exit or crashes.
+func simulate(m *Multi) (recovered, escaped int) {
+	if e := exited(m); e != nil {
+		e.N = -1 // in case it's no longer reached
 	}
-	return out
+	defer func() {
+		if r := recover(); r != nil && r != errExit {
+			panic(r)
+		}
+	}()
+	escaped = Run(m, &recovered)
+	return recovered, escaped
 }
 
-var steps, panics int
+// stop stops Run, for os.Exit or a crash.
+func stop() {
+	panic(errExit)
+}
+
+// nextStep simulates a call to step and returns its number.
+func nextStep() int {
+	steps++
+	events = append(events, fmt.Sprint("step ", steps))
+	return steps
+}
 
 func Run(m *Multi, outer *int) int {
 	panic := 0
+	returned := false
 	var defers []interface{}
 
+	// exec executes statements in this function's frame.
+	var exec func(body []*Stmt)
+
 	call := func(c interface{}, panicp *int) {
 		switch c := c.(type) {
 		case *Unit:
 			switch c.Kind {
 			case Normal:
-				steps++
-				c.N = steps
+				c.N = nextStep()
 			case Panic:
 				panics++
 				c.N = panics
 				panic = panics
+				panicBoxes[c.N] = c.Box
 			case Recover:
 				c.N = *outer
 				*outer = 0
+				events = append(events, fmt.Sprint("recover ", c.N))
 			}
 		case *Multi:
 			if n := Run(c, panicp); n != 0 {
 				panic = n
 			}
+		case *Result:
+			// Called by evalArgs.
+		case *Closure:
+			if n := Run(c.Body, panicp); n != 0 {
+				panic = n
+			}
+		case *Func:
+			if n := Run(c.Body, panicp); n != 0 {
+				panic = n
+			}
+		case *Recv:
+			for i := len(c.Ops) - 1; i >= 0; i-- {
+				op := c.Ops[i]
+				op.N = nextStep()
+				op.Want = op.Val
+				if op.Ptr {
+					op.Want = c.Final
+				}
+			}
+		case *Goto:
+			// Skipped.
+		case *Global:
+			g := c.Init
+			for i := len(c.Ops) - 1; i >= 0; i-- {
+				op := c.Ops[i]
+				op.Want = g
+				g = g*10 + op.Add
+			}
+			c.Final = g
+		case *Builtins:
+			c.Len = -1
+			for _, b := range c.Defers {
+				switch b {
+				case DeferDelete:
+					if c.Len != 0 {
+						c.Len = 1
+					}
+				case DeferClear:
+					c.Len = 0
+				}
+			}
+			if c.Panic != nil {
+				panics++
+				c.Panic.N = panics
+				panic = c.Panic.N
+			}
+		case *Variadic:
+			if c.Panic != nil {
+				panics++
+				c.Panic.N = panics
+				panic = c.Panic.N
+			}
+			c.N = nextStep()
+		case *LoopVar:
+			c.First = steps + 1
+			for i := 0; i < c.N; i++ {
+				nextStep()
+			}
+		case *Locals:
+			vars := c.Init
+			do := func(op *LocalOp) {
+				op.Want = vars[op.Var]
+				vars[op.Var] = vars[op.Var]*10 + op.Add
+			}
+			var deferred []*LocalOp
+			for _, op := range c.Ops {
+				if op.Defer {
+					deferred = append(deferred, op)
+				} else {
+					do(op)
+				}
+			}
+			for i := len(deferred) - 1; i >= 0; i-- {
+				do(deferred[i])
+			}
+			c.Final = vars
+		case *ErrResult:
+			c.Want = Run(c.Body, new(int))
+		case *Args:
+			c.N = nextStep()
+		case *Return:
+			returned = true
+		case *Exit:
+			c.N = steps
+			events = append(events, fmt.Sprint("exit ", c.N))
+			stop()
+		case *Crash:
+			Run(c.frame(), new(int))
+			c.Steps = steps
+			events = append(events, fmt.Sprint("crash ", c.Panic.N))
+			stop()
+		case *Capture:
+			defers = append(defers, c.Step)
+		case *PanicNil:
+			Run(c.Body, new(int))
+		case *Fault:
+			Run(c.Body, new(int))
+			panics++
+			c.N = panics
+			panic = c.N
+		case *NilRecover:
+			if !c.Direct {
+				events = append(events, "recover 0")
+			} else if panic == 0 {
+				// Deferred recover is called by this function
+				// as it returns, so if it's a deferred call,
+				// the panic that called it is recovered.
+				*outer = 0
+			}
+		case *NilDefer:
+			Run(c.Body, panicp)
+			panics++
+			c.N = panics
+			panic = c.N
+		case *Rebind:
+			defers = append(defers, c.Step)
+			if c.Panic != nil {
+				panics++
+				c.Panic.N = panics
+				panic = panics
+			}
+		case *Filter:
+			c.N = *panicp
+			events = append(events, fmt.Sprint("recover ", c.N))
+			if c.N%2 == 0 {
+				*panicp = 0
+			}
+		case *Switch:
+			exec(c.Arms[c.Case].Body)
+		case *Loop:
+			exec(c.Body.Body)
+		case *Init:
+			Run(c.Body, new(int))
+		case *Bulk:
+			if c.Panic != nil {
+				panics++
+				c.Panic.N = panics
+			}
+			c.First = steps + 1
+			for i := 0; i < c.Defers; i++ {
+				nextStep()
+			}
+			if c.Panic != nil {
+				panic = c.Panic.N
+			}
+		case *Recurse:
+			c.Bottom = nextStep()
+			if c.Panic != nil {
+				panics++
+				c.Panic.N = panics
+			}
+			c.Top = nextStep()
+			if c.Panic != nil {
+				panic = c.Panic.N
+			}
+		case *Generic:
+			for _, arm := range c.Arms {
+				if n := Run(arm, new(int)); n != 0 {
+					panic = n
+					break
+				}
+			}
+		case *Labeled:
+			for _, iter := range c.Iters {
+				exec(iter.Body)
+				if panic != 0 || returned {
+					break
+				}
+			}
+		case *If:
+			if c.Cond {
+				exec(c.Then.Body)
+			} else {
+				exec(c.Else.Body)
+			}
+		case *Fork:
+			if n := Run(c.frame(), panicp); n != 0 {
+				panic = n
+			}
+		case *Goexit:
+			// Goexit runs the deferred calls like returning
+			// normally, but from both frames.
+			Run(c.frame(), new(int))
+		case *RangeFunc:
+			k := c.Iters
+			if c.Panic != nil {
+				k = c.PanicAt + 1
+			}
+			c.First = steps + 1
+			for x := 0; x < k; x++ {
+				nextStep()
+			}
+			if c.Panic != nil {
+				panics++
+				c.Panic.N = panics
+			}
+			for i := len(c.IterDefers) - 1; i >= 0; i-- {
+				c.IterDefers[i] = nextStep()
+			}
+			for x := k - 1; x >= 0; x-- {
+				c.Last = nextStep()
+			}
+			if c.Panic != nil {
+				panic = c.Panic.N
+			}
+		case *ChanRecover:
+			c.N = Run(c.Body, panicp)
+			events = append(events, fmt.Sprint("recover ", c.N))
 		}
 	}
 
-	for _, stmt := range m.Body {
-		if stmt.Defer {
-			defers = append(defers, stmt.Call)
-			continue
-		}
-		call(stmt.Call, new(int))
-		if panic != 0 {
-			break
+	exec = func(body []*Stmt) {
+		for _, stmt := range body {
+			evalArgs(stmt.Call)
+			if stmt.Defer {
+				defers = append(defers, stmt.Call)
+				stmt.Note = fmt.Sprintf("registers defer #%v", len(defers))
+				continue
+			}
+			call(stmt.Call, new(int))
+			stmt.Note = "returns"
+			if u, ok := stmt.Call.(*Unit); ok && u.Kind == Normal {
+				stmt.Note = fmt.Sprintf("step %v", u.N)
+			} else if ok && u.Kind == Recover {
+				stmt.Note = fmt.Sprintf("recovers panic #%v", u.N)
+				if u.N == 0 {
+					stmt.Note = "recovers nothing"
+				}
+			}
+			if panic != 0 {
+				stmt.Note = fmt.Sprintf("panics #%v -> unwind", panic)
+				return
+			}
+			if returned {
+				stmt.Note = "returns early -> unwind"
+				return
+			}
 		}
 	}
+	exec(m.Body)
 
 	for i := len(defers) - 1; i >= 0; i-- {
 		call(defers[i], &panic)
@@ -159,97 +748,1787 @@ func Run(m *Multi, outer *int) int {
 	return panic
 }
 
-func Write(w io.Writer, m *Multi) {
+// evalArgs simulates evaluating the arguments of call c,
+// which happens at the call or defer statement.
+func evalArgs(c interface{}) {
+	switch c := c.(type) {
+	case *Args:
+		for i := range c.Args {
+			c.Args[i] = nextStep()
+		}
+	case *Result:
+		// The call is the argument of expectret.
+		r := c.Init
+		if c.Panic != nil {
+			panics++
+			c.Panic.N = panics
+			events = append(events, fmt.Sprint("recover ", c.Panic.N))
+		}
+		for i := len(c.Adds) - 1; i >= 0; i-- {
+			r = r*10 + c.Adds[i]
+		}
+		c.Want = r
+	}
+}
+
+// Write writes the statements of m to w.
+// Any top-level declarations they need are written to decls.
+func Write(w, decls io.Writer, m *Multi) {
+	write(w, decls, m, 0)
+}
+
+func write(w, decls io.Writer, m *Multi, depth int) {
 	fmt.Fprintln(w, "type _ int") // prevent inlining
 	for _, stmt := range m.Body {
+		if *explain {
+			note := stmt.Note
+			if note == "" {
+				note = "not reached"
+			}
+			fmt.Fprintf(w, "// %v\n", note)
+		}
+
+		where := fmt.Sprintf("depth %v", depth)
 		if stmt.Defer {
 			fmt.Fprint(w, "defer ")
+			where = "deferred, " + where
 		}
 
 		switch call := stmt.Call.(type) {
 		case *Unit:
 			switch call.Kind {
 			case Normal:
-				fmt.Fprintf(w, "step(%v)\n", call.N)
+				fmt.Fprintf(w, "step(%v, %q)\n", call.N, where)
 			case Panic:
+				if call.Box != "" {
+					// The box of a deferred panic is made when the
+					// defer statement runs, even if os.Exit means
+					// the panic itself never happens.
+					n := call.N
+					if n < 0 {
+						n = 0
+					}
+					fmt.Fprintf(w, "panic(%v(%v))\n", call.Box, n)
+					break
+				}
 				fmt.Fprintf(w, "panic(%v)\n", call.N)
 			case Recover:
 				if stmt.Defer {
-					log.Fatal("defer of expect(recover()) doesnt make sense")
+					fatal("defer of expect(recover()) doesnt make sense")
 				}
-				fmt.Fprintf(w, "expect(%v, recover())\n", call.N)
+				fmt.Fprintln(w, expectCall(call.N, "recover()", where))
 			}
 
 		case *Multi:
 			fmt.Fprintln(w, "func() {")
-			Write(w, call)
+			write(w, decls, call, depth+1)
 			fmt.Fprintln(w, "}()")
-		}
-	}
-}
 
-type Fuzzer struct {
-	budget int
-}
+		case *Result:
+			fmt.Fprintf(w, "expectret(%v, f%v())\n", call.Want, call.ID)
+			fmt.Fprintf(decls, "\nfunc f%v() (r int) {\ntype _ int\n", call.ID)
+			for i, add := range call.Adds {
+				fmt.Fprintln(decls, "defer func() {\ntype _ int")
+				if i == 0 && call.Panic != nil {
+					fmt.Fprintln(decls, expectCall(call.Panic.N, "recover()", fmt.Sprintf("result f%v", call.ID)))
+				}
+				fmt.Fprintf(decls, "r = r*10 + %v\n}()\n", add)
+			}
+			fmt.Fprintf(decls, "r = %v\n", call.Init)
+			if call.Panic != nil {
+				fmt.Fprintf(decls, "panic(%v)\n}\n", call.Panic.N)
+			} else {
+				fmt.Fprintln(decls, "return\n}")
+			}
 
-func (f *Fuzzer) Fill(m *Multi) {
-	for f.budget > 0 {
-		Defer := false
-		if rand.Intn(2) == 0 {
-			Defer = true
-		}
+		case *Closure:
+			fmt.Fprintf(w, "make%v()()\n", call.ID)
+			var body bytes.Buffer
+			write(&body, decls, call.Body, depth+1)
+			fmt.Fprintf(decls, "\nfunc make%v() func() {\ntype _ int\nx := %v\nreturn func() {\ndefer func() {\ntype _ int\nexpectret(%v, x)\n}()\n%s}\n}\n", call.ID, call.X, call.X, body.Bytes())
 
-		var call interface{}
-		var waspanic bool
-		switch rand.Intn(10) {
-		case 0, 4, 5, 6:
-			b2 := rand.Intn(f.budget)
-			f.budget -= b2
-			m2 := new(Multi)
-			f2 := &Fuzzer{budget: b2}
-			f2.Fill(m2)
-			f.budget += f2.budget
-			call = m2
-		case 2, 7, 8:
-			if !Defer {
-				call = &Unit{Kind: Recover, N: -1}
-				f.budget--
-				break
+		case *Func:
+			fmt.Fprintf(w, "fn%v()\n", call.ID)
+			var body bytes.Buffer
+			write(&body, decls, call.Body, depth+1)
+			fmt.Fprintf(decls, "\nfunc fn%v() {\n%s}\n", call.ID, body.Bytes())
+
+		case *Recv:
+			fmt.Fprintln(w, "func() {\ntype _ int\nvar t T")
+			for _, op := range call.Ops {
+				fmt.Fprintf(w, "t.n = %v\ndefer %v\n", op.Val, op.call())
 			}
-			fallthrough
-		case 1, 9:
-			call = &Unit{Kind: Normal, N: -1}
-			f.budget--
-		case 3:
-			call = &Unit{Kind: Panic, N: -1}
-			f.budget--
-			waspanic = true
-		}
-		m.Body = append(m.Body, &Stmt{Defer: Defer, Call: call})
-		if waspanic && !Defer {
-			break
-		}
-	}
-}
+			fmt.Fprintf(w, "t.n = %v\n}()\n", call.Final)
 
-type Stmt struct {
-	Defer bool
-	Call  interface{} // *Unit or *Multi
-}
+		case *Goto:
+			if stmt.Defer {
+				fatal("defer of goto doesnt make sense")
+			}
+			fmt.Fprintf(w, "goto L%v\n{\n", call.ID)
+			write(w, decls, call.Body, depth)
+			// The label needs a statement, in case it ends a case.
+			fmt.Fprintf(w, "}\nL%v:\n;\n", call.ID)
 
-type Kind int
+		case *Global:
+			fmt.Fprintf(w, "func() {\ntype _ int\ndefer func() {\ntype _ int\nexpectret(%v, g)\n}()\n", call.Final)
+			for _, op := range call.Ops {
+				fmt.Fprintf(w, "defer func() {\ntype _ int\nexpectret(%v, g)\ng = g*10 + %v\n}()\n", op.Want, op.Add)
+			}
+			fmt.Fprintf(w, "g = %v\n}()\n", call.Init)
 
-const (
-	Normal Kind = iota
-	Recover
-	Panic
-)
+		case *Builtins:
+			has := make(map[Builtin]bool)
+			for _, b := range call.Defers {
+				has[b] = true
+			}
+			fmt.Fprintln(w, "func() {\ntype _ int")
+			if has[DeferClose] {
+				fmt.Fprintln(w, "ch := make(chan int, 1)")
+			}
+			if has[DeferDelete] || has[DeferClear] {
+				fmt.Fprintln(w, "m := map[int]int{}")
+			}
+			if has[DeferCopy] {
+				fmt.Fprintln(w, "dst, src := []int{0}, []int{1}")
+			}
+			fmt.Fprintln(w, "defer func() {\ntype _ int")
+			if has[DeferClose] {
+				fmt.Fprintf(w, "if v, ok := <-ch; v != 7 || !ok {\nlog.Fatalf(\"deferred close: first receive got %%v, %%v\", v, ok)\n}\nif _, ok := <-ch; ok {\nlog.Fatal(\"deferred close: channel not closed\")\n}\n")
+			}
+			if has[DeferDelete] || has[DeferClear] {
+				fmt.Fprintf(w, "if len(m) != %v {\nlog.Fatalf(\"deferred delete and clear: have %%v, want %v entries\", len(m))\n}\n", call.Len, call.Len)
+			}
+			if has[DeferCopy] {
+				fmt.Fprintf(w, "if dst[0] != 2 {\nlog.Fatalf(\"deferred copy: have %%v, want 2\", dst[0])\n}\n")
+			}
+			fmt.Fprintln(w, "}()")
+			for _, b := range call.Defers {
+				fmt.Fprintf(w, "defer %v\n", [...]string{DeferClose: "close(ch)", DeferDelete: "delete(m, 1)", DeferClear: "clear(m)", DeferCopy: "copy(dst, src)", DeferPrint: "println()"}[b])
+			}
+			// Affect the deferred calls, which haven't run yet.
+			if has[DeferClose] {
+				fmt.Fprintln(w, "ch <- 7")
+			}
+			if has[DeferDelete] || has[DeferClear] {
+				fmt.Fprintln(w, "m[1], m[2] = 1, 2")
+			}
+			if has[DeferCopy] {
+				fmt.Fprintln(w, "src[0] = 2\nsrc = []int{3}")
+			}
+			if call.Panic != nil {
+				fmt.Fprintf(w, "panic(%v)\n", call.Panic.N)
+			}
+			fmt.Fprintln(w, "}()")
 
-type Unit struct {
-	Kind Kind
-	N    int
-}
+		case *Variadic:
+			fmt.Fprintln(w, "func() {\ntype _ int")
+			fmt.Fprint(w, "s := []int{")
+			for i := 0; i < call.Len; i++ {
+				fmt.Fprintf(w, "%v, ", 10*(i+1))
+			}
+			fmt.Fprintln(w, "}")
+			fmt.Fprintf(w, "defer func(args ...int) {\ntype _ int\nstep(%v, %q)\n", call.N, "deferred variadic")
+			if !call.Spread && call.Args == 0 {
+				fmt.Fprintln(w, "if args != nil {\nlog.Fatal(\"deferred variadic: non-nil args\")\n}")
+			}
+			want := call.want()
+			fmt.Fprintf(w, "if want := %#v; len(args) != len(want) {\nlog.Fatalf(\"deferred variadic: have args %%v, want %%v\", args, want)\n}", want)
+			fmt.Fprintf(w, " else {\nfor i := range want {\nif args[i] != want[i] {\nlog.Fatalf(\"deferred variadic: have args %%v, want %%v\", args, want)\n}\n}\n}\n")
+			fmt.Fprint(w, "}(")
+			if call.Spread {
+				fmt.Fprint(w, "s...")
+			} else {
+				for i := 0; i < call.Args; i++ {
+					fmt.Fprintf(w, "s[%v], ", i)
+				}
+			}
+			fmt.Fprintln(w, ")")
+			// Change s, which the deferred call shares only if
+			// it's spread, and only its elements.
+			if call.Len > 0 {
+				fmt.Fprintln(w, "s[0] = -1")
+			}
+			fmt.Fprintln(w, "s = append(s, -2)")
+			if call.Panic != nil {
+				fmt.Fprintf(w, "panic(%v)\n", call.Panic.N)
+			}
+			fmt.Fprintln(w, "}()")
 
-type Multi struct {
-	Body []*Stmt
+		case *LoopVar:
+			if call.Range {
+				fmt.Fprintf(w, "func() {\ntype _ int\nfor i := range [%v]struct{}{} {\n", call.N)
+			} else {
+				fmt.Fprintf(w, "func() {\ntype _ int\nfor i := 0; i < %v; i++ {\n", call.N)
+			}
+			if call.Copy {
+				fmt.Fprintln(w, "i := i")
+			}
+			want := "k"
+			if call.Shared {
+				want = fmt.Sprint(call.N)
+				if call.Range {
+					want = fmt.Sprint(call.N - 1)
+				}
+			}
+			fmt.Fprintf(w, "k := i\ndefer func() {\ntype _ int\nstep(%v-k, %q)\nexpectret(%v, i)\n}()\n}\n}()\n", call.First+call.N-1, "deferred in loop", want)
+
+		case *Locals:
+			fmt.Fprintf(w, "func() {\ntype _ int\na, b := %v, %v\ndefer func() {\ntype _ int\nexpectret(%v, a)\nexpectret(%v, b)\n}()\n", call.Init[0], call.Init[1], call.Final[0], call.Final[1])
+			for _, op := range call.Ops {
+				if op.Defer {
+					fmt.Fprint(w, "defer ")
+				}
+				v := "ab"[op.Var : op.Var+1]
+				fmt.Fprintf(w, "func() {\ntype _ int\nexpectret(%v, %v)\n%v = %v*10 + %v\n}()\n", op.Want, v, v, v, op.Add)
+			}
+			fmt.Fprintln(w, "}()")
+
+		case *ErrResult:
+			if call.Bad {
+				fmt.Fprintf(w, "expectassert(f%v)\n", call.ID)
+			} else {
+				fmt.Fprintf(w, "expecterr(%v, f%v())\n", call.Want, call.ID)
+			}
+			var body bytes.Buffer
+			write(&body, decls, call.Body, depth+1)
+			fmt.Fprintf(decls, "\nfunc f%v() (err error) {\ndefer func() {\ntype _ int\nif r := recover(); r != nil {\nerr = r.(error)\n}\n}()\n%s}\n", call.ID, body.Bytes())
+
+		case *Return:
+			fmt.Fprintln(w, "return")
+
+		case *Exit:
+			fmt.Fprintf(w, "exit(%v)\n", call.N)
+
+		case *Args:
+			fmt.Fprintf(w, "step3(%v, arg(%v), arg(%v), arg(%v))\n", call.N, call.Args[0], call.Args[1], call.Args[2])
+
+		case *Capture:
+			if stmt.Defer {
+				fatal("defer of capture doesnt make sense")
+			}
+			where = "deferred with captured argument, " + where
+			fmt.Fprintf(w, "{\nx := %v\n", call.Step.N)
+			if call.Lit {
+				fmt.Fprintf(w, "defer func(x int) {\ntype _ int\nstep(x, %q)\n}(x)\n", where)
+			} else {
+				fmt.Fprintf(w, "defer step(x, %q)\n", where)
+			}
+			fmt.Fprintln(w, "x = -1\n}")
+
+		case *PanicNil:
+			fmt.Fprintf(w, "func() {\ntype _ int\ndefer func() {\ntype _ int\nr := recover()\nprintln(\"expectpanicnil\")\n")
+			fmt.Fprintf(w, "if _, ok := r.(*runtime.PanicNilError); !ok && !(r == nil && panicnil) {\nlog.Fatalf(\"recover: have %%v, want *runtime.PanicNilError (%%v)\", r, %q)\n}\n}()\n", where)
+			write(w, decls, call.Body, depth+1)
+			fmt.Fprintln(w, "panic(nil)\n}()")
+
+		case *Fault:
+			fmt.Fprintf(w, "func() {\ntype _ int\ndefer func() {\ntype _ int\nexpectfault(recover(), %q, %v)\n}()\n", faults[call.Kind].msg, call.N)
+			write(w, decls, call.Body, depth+1)
+			fmt.Fprintf(w, "%v\n}()\n", faults[call.Kind].stmt)
+
+		case *NilRecover:
+			if !stmt.Defer {
+				fatal("call of nil recover doesnt make sense")
+			}
+			if call.Direct {
+				fmt.Fprintln(w, "recover()")
+				break
+			}
+			fmt.Fprintf(w, "func() {\ntype _ int\nexpect(0, recoverhelper(), %q)\n}()\n", where)
+
+		case *NilDefer:
+			fmt.Fprintf(w, "func() {\ntype _ int\ndefer func() {\ntype _ int\nexpectnil(recover(), %v)\n}()\nvar fn func()\ndefer fn()\n", call.N)
+			write(w, decls, call.Body, depth+1)
+			fmt.Fprintln(w, "}()")
+
+		case *Rebind:
+			if stmt.Defer {
+				fatal("defer of rebind doesnt make sense")
+			}
+			fmt.Fprintf(w, "{\nfn := func() {\ntype _ int\nstep(%v, %q)\n}\ndefer fn()\n", call.Step.N, "deferred before rebinding, "+where)
+			fmt.Fprintf(w, "fn = func() {\ntype _ int\nstep(-1, %q)\n}\n", "rebound, "+where)
+			if call.Panic != nil {
+				fmt.Fprintf(w, "panic(%v)\n", call.Panic.N)
+			}
+			fmt.Fprintln(w, "}")
+
+		case *Switch:
+			if stmt.Defer {
+				fatal("defer of switch doesnt make sense")
+			}
+			last := len(call.Arms) - 1
+			switch call.Kind {
+			case ExprSwitch:
+				fmt.Fprintf(w, "switch ints[%v] {\n", call.Case)
+			case TypeSwitch:
+				n := len(typeCases)
+				if call.Case != last {
+					n = call.Case
+				}
+				fmt.Fprintf(w, "switch values[%v].(type) {\n", n)
+			case SelectSwitch:
+				fmt.Fprintln(w, "select {")
+			}
+			for i, arm := range call.Arms {
+				switch {
+				case i == last:
+					fmt.Fprintln(w, "default:")
+				case call.Kind == ExprSwitch:
+					fmt.Fprintf(w, "case %v:\n", i)
+				case call.Kind == TypeSwitch:
+					fmt.Fprintf(w, "case %v:\n", typeCases[i])
+				case i == call.Case:
+					fmt.Fprintln(w, "case <-closed:")
+				default:
+					fmt.Fprintln(w, "case <-block:")
+				}
+				write(w, decls, arm, depth)
+			}
+			fmt.Fprintln(w, "}")
+
+		case *Loop:
+			if stmt.Defer {
+				fatal("defer of loop doesnt make sense")
+			}
+			fmt.Fprintln(w, "for {")
+			write(w, decls, call.Body, depth)
+			fmt.Fprintln(w, "break\n}")
+
+		case *Labeled:
+			if stmt.Defer {
+				fatal("defer of labeled loop doesnt make sense")
+			}
+			last := len(call.Iters) - 1
+			if last > 0 || !call.Goto {
+				fmt.Fprintf(w, "L%v:\n", call.ID)
+			}
+			fmt.Fprintln(w, "for i := 0; ; i++ {\nfor {\nswitch i {")
+			for i, iter := range call.Iters {
+				fmt.Fprintf(w, "case %v:\n", i)
+				write(w, decls, iter, depth)
+				switch {
+				case i < last:
+					fmt.Fprintf(w, "continue L%v\n", call.ID)
+				case call.Goto:
+					fmt.Fprintf(w, "goto X%v\n", call.ID)
+				default:
+					fmt.Fprintf(w, "break L%v\n", call.ID)
+				}
+			}
+			fmt.Fprintln(w, "}")
+			write(w, decls, call.Skipped, depth)
+			fmt.Fprintln(w, "break\n}\n}")
+			if call.Goto {
+				// The label needs a statement, in case it ends a case.
+				fmt.Fprintf(w, "X%v:\n;\n", call.ID)
+			}
+
+		case *If:
+			if stmt.Defer {
+				fatal("defer of if doesnt make sense")
+			}
+			cond := "no"
+			if call.Cond {
+				cond = "yes"
+			}
+			fmt.Fprintf(w, "if %v {\n", cond)
+			write(w, decls, call.Then, depth)
+			fmt.Fprintln(w, "} else {")
+			write(w, decls, call.Else, depth)
+			fmt.Fprintln(w, "}")
+
+		case *Fork:
+			fmt.Fprintln(w, "func() {\nstart := make(chan bool)\nwait := start")
+			if call.WaitGroup {
+				fmt.Fprintln(w, "var wg sync.WaitGroup")
+			}
+			for _, body := range call.Bodies {
+				fmt.Fprintln(w, "{\nprev, done := wait, make(chan bool)")
+				if call.WaitGroup {
+					fmt.Fprintln(w, "wg.Add(1)\ngo func() {\ndefer wg.Done()")
+				} else {
+					fmt.Fprintln(w, "go func() {")
+				}
+				fmt.Fprintln(w, "defer close(done)\n<-prev\nfunc() {")
+				write(w, decls, body, depth+2)
+				fmt.Fprintln(w, "}()\n}()\nwait = done\n}")
+			}
+			write(w, decls, call.Pre, depth+1)
+			if call.WaitGroup {
+				fmt.Fprintln(w, "close(start)\nwg.Wait()")
+			} else {
+				fmt.Fprintln(w, "close(start)\n<-wait")
+			}
+			write(w, decls, call.Post, depth+1)
+			fmt.Fprintln(w, "}()")
+
+		case *Bulk:
+			fmt.Fprintln(w, "func() {\ntype _ int")
+			last := call.First + call.Defers - 1
+			if call.Loop {
+				fmt.Fprintf(w, "for i := 0; i < %v; i++ {\ndefer step(%v-i, %q)\n}\n", call.Defers, last, "bulk deferred in loop")
+			} else {
+				for i := 0; i < call.Defers; i++ {
+					fmt.Fprintf(w, "defer step(%v, %q)\n", last-i, "bulk deferred")
+				}
+			}
+			if call.Panic != nil {
+				fmt.Fprintf(w, "panic(%v)\n", call.Panic.N)
+			}
+			fmt.Fprintln(w, "}()")
+
+		case *Recurse:
+			fmt.Fprintf(w, "func() {\ntype _ int\nx := -1\ndefer step(%v, %q)\nr%v(0, &x)\n}()\n", call.Top, "after recursion", call.ID)
+			fmt.Fprintf(decls, "\nfunc r%v(d int, p *int) {\ntype _ int\nvar pad [32]int\npad[d%%32] = d\n", call.ID)
+			fmt.Fprintf(decls, "defer func() {\ntype _ int\nif level != d || *p != d-1 || pad[d%%32] != d {\nlog.Fatalf(\"r%v: have level %%v, *p %%v, pad %%v at depth %%v\", level, *p, pad[d%%32], d)\n}\nlevel--\n}()\n", call.ID)
+			fmt.Fprintf(decls, "level = d\nx := d\nif d < %v {\nr%v(d+1, &x)\nreturn\n}\nstep(%v, %q)\n", call.Depth-1, call.ID, call.Bottom, "bottom of recursion")
+			if call.Panic != nil {
+				fmt.Fprintf(decls, "panic(%v)\n", call.Panic.N)
+			}
+			fmt.Fprintln(decls, "}")
+
+		case *Init:
+			var body bytes.Buffer
+			write(&body, decls, call.Body, depth+1)
+			fmt.Fprintf(decls, "\nfunc init() {\n%s}\n", body.Bytes())
+
+		case *Generic:
+			fmt.Fprintln(w, "func() {")
+			for i, t := range call.Types {
+				typ := genericTypes[t]
+				if call.Method {
+					fmt.Fprintf(w, "G%v[%v]{%v}.call(%v, %v)\n", call.ID, typ.typ, typ.val, i, typ.val)
+				} else {
+					fmt.Fprintf(w, "g%v[%v](%v, %v, %v)\n", call.ID, typ.typ, i, typ.val, typ.val)
+				}
+			}
+			fmt.Fprintln(w, "}()")
+			var body bytes.Buffer
+			for i, arm := range call.Arms {
+				fmt.Fprintf(&body, "case %v:\n", i)
+				write(&body, decls, arm, depth+1)
+			}
+			if call.Method {
+				fmt.Fprintf(decls, "\ntype G%v[A any] struct{ v A }\n\nfunc (gen G%v[A]) call(k int, want A) {\nv := gen.v\n", call.ID, call.ID)
+			} else {
+				fmt.Fprintf(decls, "\nfunc g%v[A any](k int, v, want A) {\n", call.ID)
+			}
+			fmt.Fprintf(decls, "type _ int\ndefer func(v A) {\ntype _ int\nif any(v) != any(want) {\nlog.Fatalf(\"g%v: have %%v, want %%v\", v, want)\n}\n}(v)\nv = *new(A)\nswitch k {\n%s}\n}\n", call.ID, body.Bytes())
+
+		case *Crash:
+			fmt.Fprintf(w, "func() {\ngo func() {\ndefer crashed(%v, %v)\n", call.Panic.N, call.Steps)
+			write(w, decls, call.frame(), depth+1)
+			fmt.Fprintln(w, "}()\n<-block\n}()")
+
+		case *Goexit:
+			fmt.Fprintln(w, "func() {\ndone := make(chan bool)\ngo func() {\ndefer close(done)")
+			write(w, decls, call.Outer, depth+2)
+			fmt.Fprintln(w, "func() {")
+			write(w, decls, call.Inner, depth+3)
+			fmt.Fprintln(w, "runtime.Goexit()\n}()\npanic(\"Goexit returned\")\n}()\n<-done\n}()")
+
+		case *RangeFunc:
+			fmt.Fprintf(w, "func() {\ntype _ int\nfor x := range iter%v {\ndefer step(%v-x, %q)\nstep(%v+x, %q)\n", call.ID, call.Last, "deferred in range-over-func", call.First, "range-over-func")
+			if call.Panic != nil {
+				fmt.Fprintf(w, "if x == %v {\npanic(%v)\n}\n", call.PanicAt, call.Panic.N)
+			}
+			fmt.Fprintln(w, "}\n}()")
+			fmt.Fprintf(decls, "\nfunc iter%v(yield func(int) bool) {\ntype _ int\n", call.ID)
+			for _, n := range call.IterDefers {
+				fmt.Fprintf(decls, "defer step(%v, %q)\n", n, "deferred in iterator")
+			}
+			fmt.Fprintf(decls, "for i := 0; i < %v; i++ {\nif !yield(i) {\nreturn\n}\n}\n}\n", call.Iters)
+
+		case *ChanRecover:
+			fmt.Fprintf(w, "func() {\nch := make(chan interface{}, 1)\ndefer func() {\ntype _ int\n%v\n}()\ndefer func() {\ntype _ int\nch <- recover()\n}()\n", expectCall(call.N, "<-ch", where))
+			write(w, decls, call.Body, depth+1)
+			fmt.Fprintln(w, "}()")
+
+		case *Filter:
+			fmt.Fprintf(w, "func() {\ntype _ int\nr := recover()\n%v\nif r != nil && suppress(r) {\nreturn\n}\nif r != nil {\npanic(r)\n}\n}()\n", expectCall(call.N, "r", where))
+		}
+	}
+}
+
+// expectCall returns a call checking that v, a recovered panic value,
+// is the panic numbered n by Run, made by its Box, if any.
+func expectCall(n int, v, where string) string {
+	if box := panicBoxes[n]; box != "" && n > 0 {
+		return fmt.Sprintf("expectbox(%v, %q, %v, %q)", n, box, v, where)
+	}
+	return fmt.Sprintf("expect(%v, %v, %q)", n, v, where)
+}
+
+// DumpTree writes a human-readable outline of m to w.
+func DumpTree(w io.Writer, m *Multi) {
+	dumpTree(w, m, 0)
+}
+
+func dumpTree(w io.Writer, m *Multi, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, stmt := range m.Body {
+		prefix := indent
+		if stmt.Defer {
+			prefix += "defer "
+		}
+
+		switch call := stmt.Call.(type) {
+		case *Unit:
+			switch call.Kind {
+			case Normal:
+				fmt.Fprintf(w, "%sstep %v\n", prefix, call.N)
+			case Panic:
+				if call.Box != "" {
+					fmt.Fprintf(w, "%spanic %v(%v)\n", prefix, call.Box, call.N)
+					break
+				}
+				fmt.Fprintf(w, "%spanic %v\n", prefix, call.N)
+			case Recover:
+				fmt.Fprintf(w, "%srecover %v\n", prefix, call.N)
+			}
+		case *Multi:
+			fmt.Fprintf(w, "%sfunc\n", prefix)
+			dumpTree(w, call, depth+1)
+		case *Result:
+			fmt.Fprintf(w, "%sresult f%v: r = %v, defers r = r*10 + %v", prefix, call.ID, call.Init, call.Adds)
+			if call.Panic != nil {
+				fmt.Fprintf(w, ", panic %v recovered by the first", call.Panic.N)
+			}
+			fmt.Fprintf(w, "; want %v\n", call.Want)
+		case *Closure:
+			fmt.Fprintf(w, "%sclosure make%v: x = %v\n", prefix, call.ID, call.X)
+			dumpTree(w, call.Body, depth+1)
+		case *Func:
+			fmt.Fprintf(w, "%sfunc fn%v\n", prefix, call.ID)
+			dumpTree(w, call.Body, depth+1)
+		case *Recv:
+			fmt.Fprintf(w, "%sreceivers: final t.n = %v\n", prefix, call.Final)
+			for _, op := range call.Ops {
+				fmt.Fprintf(w, "%s  t.n = %v; defer %v\n", indent, op.Val, op.call())
+			}
+		case *Goto:
+			fmt.Fprintf(w, "%sgoto L%v over\n", prefix, call.ID)
+			dumpTree(w, call.Body, depth+1)
+		case *Global:
+			fmt.Fprintf(w, "%sglobal: g = %v, final %v\n", prefix, call.Init, call.Final)
+			for _, op := range call.Ops {
+				fmt.Fprintf(w, "%s  defer: want %v; g = g*10 + %v\n", indent, op.Want, op.Add)
+			}
+		case *Builtins:
+			fmt.Fprintf(w, "%sdefer builtins", prefix)
+			for _, b := range call.Defers {
+				fmt.Fprintf(w, " %v", [...]string{DeferClose: "close", DeferDelete: "delete", DeferClear: "clear", DeferCopy: "copy", DeferPrint: "println"}[b])
+			}
+			if call.Panic != nil {
+				fmt.Fprintf(w, ", then panic %v", call.Panic.N)
+			}
+			fmt.Fprintln(w)
+		case *Variadic:
+			if call.Spread {
+				fmt.Fprintf(w, "%sdeferred variadic step %v of slice of %v spread", prefix, call.N, call.Len)
+			} else {
+				fmt.Fprintf(w, "%sdeferred variadic step %v of %v arguments", prefix, call.N, call.Args)
+			}
+			if call.Panic != nil {
+				fmt.Fprintf(w, ", then panic %v", call.Panic.N)
+			}
+			fmt.Fprintln(w)
+		case *LoopVar:
+			sem := "per-iteration"
+			if call.Copy {
+				sem = "copied"
+			} else if call.Shared {
+				sem = "shared"
+			}
+			kind := "for"
+			if call.Range {
+				kind = "range"
+			}
+			fmt.Fprintf(w, "%s%v loop of %v iterations deferring closures over %v i: steps %v to %v\n", prefix, kind, call.N, sem, call.First, call.First+call.N-1)
+		case *Locals:
+			fmt.Fprintf(w, "%slocals: a, b = %v, %v, final %v, %v\n", prefix, call.Init[0], call.Init[1], call.Final[0], call.Final[1])
+			for _, op := range call.Ops {
+				v := "ab"[op.Var : op.Var+1]
+				if op.Defer {
+					fmt.Fprintf(w, "%s  defer: want %v; %v = %v*10 + %v\n", indent, op.Want, v, v, op.Add)
+				} else {
+					fmt.Fprintf(w, "%s  call: want %v; %v = %v*10 + %v\n", indent, op.Want, v, v, op.Add)
+				}
+			}
+		case *ErrResult:
+			if call.Bad {
+				fmt.Fprintf(w, "%serror result f%v: bad assertion\n", prefix, call.ID)
+			} else {
+				fmt.Fprintf(w, "%serror result f%v: want %v\n", prefix, call.ID, call.Want)
+			}
+			dumpTree(w, call.Body, depth+1)
+		case *Return:
+			fmt.Fprintf(w, "%sreturn\n", prefix)
+		case *Exit:
+			fmt.Fprintf(w, "%sexit after step %v\n", prefix, call.N)
+		case *Args:
+			fmt.Fprintf(w, "%sstep %v with argument steps %v\n", prefix, call.N, call.Args)
+		case *Capture:
+			fmt.Fprintf(w, "%sx = %v; defer step(x); x = -1\n", prefix, call.Step.N)
+		case *Fault:
+			fmt.Fprintf(w, "%s%v, then panic %v\n", prefix, faults[call.Kind].msg, call.N)
+			dumpTree(w, call.Body, depth+1)
+		case *PanicNil:
+			fmt.Fprintf(w, "%spanic nil\n", prefix)
+			dumpTree(w, call.Body, depth+1)
+		case *NilRecover:
+			if call.Direct {
+				fmt.Fprintf(w, "%srecover directly\n", prefix)
+			} else {
+				fmt.Fprintf(w, "%srecover in helper\n", prefix)
+			}
+		case *NilDefer:
+			fmt.Fprintf(w, "%sdefer nil function, then panic %v\n", prefix, call.N)
+			dumpTree(w, call.Body, depth+1)
+		case *Rebind:
+			fmt.Fprintf(w, "%sfn = step %v; defer fn(); fn = step -1\n", prefix, call.Step.N)
+			if call.Panic != nil {
+				fmt.Fprintf(w, "%s  panic %v\n", indent, call.Panic.N)
+			}
+		case *Filter:
+			fmt.Fprintf(w, "%sfilter %v\n", prefix, call.N)
+		case *Switch:
+			fmt.Fprintf(w, "%s%v, taking arm %v\n", prefix, [...]string{ExprSwitch: "switch", TypeSwitch: "type switch", SelectSwitch: "select"}[call.Kind], call.Case)
+			for i, arm := range call.Arms {
+				fmt.Fprintf(w, "%s  arm %v\n", indent, i)
+				dumpTree(w, arm, depth+2)
+			}
+		case *Loop:
+			fmt.Fprintf(w, "%sloop once\n", prefix)
+			dumpTree(w, call.Body, depth+1)
+		case *Labeled:
+			fmt.Fprintf(w, "%sloop L%v\n", prefix, call.ID)
+			for i, iter := range call.Iters {
+				jump := "continue"
+				if i == len(call.Iters)-1 {
+					jump = "break"
+					if call.Goto {
+						jump = "goto"
+					}
+				}
+				fmt.Fprintf(w, "%s  iteration %v, then %v\n", indent, i, jump)
+				dumpTree(w, iter, depth+2)
+			}
+			fmt.Fprintf(w, "%s  skipped\n", indent)
+			dumpTree(w, call.Skipped, depth+2)
+		case *If:
+			fmt.Fprintf(w, "%sif %v\n", prefix, call.Cond)
+			dumpTree(w, call.Then, depth+1)
+			fmt.Fprintf(w, "%selse\n", indent)
+			dumpTree(w, call.Else, depth+1)
+		case *Fork:
+			fmt.Fprintf(w, "%sfork\n", prefix)
+			for _, body := range call.Bodies {
+				fmt.Fprintf(w, "%s  goroutine\n", indent)
+				dumpTree(w, body, depth+2)
+			}
+			dumpTree(w, call.Pre, depth+1)
+			if call.WaitGroup {
+				fmt.Fprintf(w, "%s  join with WaitGroup\n", indent)
+			} else {
+				fmt.Fprintf(w, "%s  join\n", indent)
+			}
+			dumpTree(w, call.Post, depth+1)
+		case *Bulk:
+			fmt.Fprintf(w, "%sfunc with %v defers", prefix, call.Defers)
+			if call.Loop {
+				fmt.Fprintf(w, " in a loop")
+			}
+			fmt.Fprintf(w, ": steps %v to %v", call.First, call.First+call.Defers-1)
+			if call.Panic != nil {
+				fmt.Fprintf(w, ", after panic %v", call.Panic.N)
+			}
+			fmt.Fprintln(w)
+		case *Recurse:
+			fmt.Fprintf(w, "%srecursion r%v to depth %v: step %v", prefix, call.ID, call.Depth, call.Bottom)
+			if call.Panic != nil {
+				fmt.Fprintf(w, ", panic %v", call.Panic.N)
+			}
+			fmt.Fprintf(w, "; deferred step %v\n", call.Top)
+		case *Init:
+			fmt.Fprintf(w, "%sinit\n", prefix)
+			dumpTree(w, call.Body, depth+1)
+		case *Generic:
+			name := fmt.Sprintf("g%v", call.ID)
+			if call.Method {
+				name = fmt.Sprintf("G%v.call", call.ID)
+			}
+			for i, t := range call.Types {
+				fmt.Fprintf(w, "%s%v[%v]\n", prefix, name, genericTypes[t].typ)
+				dumpTree(w, call.Arms[i], depth+1)
+			}
+		case *Crash:
+			fmt.Fprintf(w, "%sgoroutine crashing with panic %v after step %v\n", prefix, call.Panic.N, call.Steps)
+			dumpTree(w, call.Body, depth+1)
+		case *Goexit:
+			fmt.Fprintf(w, "%sgoroutine\n", prefix)
+			dumpTree(w, call.Outer, depth+1)
+			fmt.Fprintf(w, "%s  func\n", indent)
+			dumpTree(w, call.Inner, depth+2)
+			fmt.Fprintf(w, "%s    goexit\n", indent)
+		case *RangeFunc:
+			fmt.Fprintf(w, "%srange over iter%v: %v iterations, first step %v, last step %v, iterator defers %v\n", prefix, call.ID, call.Iters, call.First, call.Last, call.IterDefers)
+			if call.Panic != nil {
+				fmt.Fprintf(w, "%s  panic %v in iteration %v\n", indent, call.Panic.N, call.PanicAt)
+			}
+		case *ChanRecover:
+			fmt.Fprintf(w, "%srecover %v through channel\n", prefix, call.N)
+			dumpTree(w, call.Body, depth+1)
+		}
+	}
+}
+
+type Fuzzer struct {
+	rand     decider
+	budget   int
+	w        Weights
+	depth    int // nesting depth of the Multi being filled
+	maxDepth int // maximum nesting depth, or 0 for no limit
+	ids      int // last ID assigned to a top-level declaration
+	lang     int // minor Go language version, or 0 for the oldest supported
+}
+
+func (f *Fuzzer) Fill(m *Multi) {
+	for f.budget > 0 {
+		Defer := f.pick(f.w.Defer, f.w.Call) == 0
+
+		nest, extra := f.w.Nest, f.w.Extra
+		if f.maxDepth > 0 && f.depth >= f.maxDepth {
+			nest, extra = 0, 0
+			if f.w.Step+f.w.Recover+f.w.Panic == 0 {
+				nest = 1 // becomes a step below
+			}
+		}
+
+		var call interface{}
+		var waspanic bool
+		switch f.pick(nest, f.w.Step, f.w.Recover, f.w.Panic, extra) {
+		case 0:
+			call = f.sub()
+		case 2:
+			if !Defer {
+				call = &Unit{Kind: Recover, N: -1}
+				f.budget--
+				break
+			}
+			fallthrough
+		case 1:
+			call = &Unit{Kind: Normal, N: -1}
+			f.budget--
+		case 3:
+			call = &Unit{Kind: Panic, N: -1, Box: boxes[f.rand.Intn(len(boxes))]}
+			f.budget--
+			waspanic = true
+		case 4:
+			call, Defer = f.extra(Defer)
+		}
+		if f.maxDepth > 0 && f.depth+height(call) > f.maxDepth {
+			call = &Unit{Kind: Normal, N: -1}
+		}
+		m.Body = append(m.Body, &Stmt{Defer: Defer, Call: call})
+		if waspanic && !Defer {
+			break
+		}
+	}
+}
+
+// sub returns a new Multi filled using a random portion of f's budget.
+func (f *Fuzzer) sub() *Multi {
+	m := new(Multi)
+	if f.budget <= 0 {
+		return m
+	}
+	b2 := f.rand.Intn(f.budget)
+	if b2 == 0 {
+		// An empty function literal still costs a call, or Fill
+		// would never finish when every decision is 0, as when
+		// a decision log runs out.
+		f.budget--
+		return m
+	}
+	rest := f.budget - b2
+	f.budget = b2
+	f.depth++
+	f.Fill(m)
+	f.depth--
+	f.budget += rest
+	return m
+}
+
+// extra returns a call exercising one of the less common defer
+// patterns, which are each too specific to warrant a case in Fill,
+// and whether to defer it.
+func (f *Fuzzer) extra(Defer bool) (interface{}, bool) {
+	f.budget--
+	if n := *bulkDefers; n > 0 && f.rand.Intn(4) == 0 {
+		b := &Bulk{Defers: n/2 + f.rand.Intn(n+1), Loop: f.rand.Intn(2) == 0}
+		if f.rand.Intn(2) == 0 {
+			b.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		return b, Defer
+	}
+	switch f.rand.Intn(38) {
+	case 0:
+		r := &Result{ID: f.id(), Init: 1 + f.rand.Intn(9), Adds: []int{1 + f.rand.Intn(9)}}
+		for n := f.rand.Intn(3); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			r.Adds = append(r.Adds, 1+f.rand.Intn(9))
+		}
+		if f.rand.Intn(2) == 0 {
+			r.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		return r, Defer
+	case 1:
+		return &Closure{ID: f.id(), X: f.rand.Intn(100), Body: f.sub()}, Defer
+	case 2:
+		r := &Recv{Final: f.rand.Intn(100)}
+		for n := 1 + f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			r.Ops = append(r.Ops, &RecvOp{Ptr: f.rand.Intn(2) == 0, Via: f.rand.Intn(3), Val: f.rand.Intn(100)})
+		}
+		return r, Defer
+	case 3:
+		// A deferred function that panics and recovers its own
+		// panic, which must not escape to the function deferring it.
+		return B().Defer(f.recovering()).Append(f.sub()).Build(), Defer
+	case 4:
+		// A function that registers a defer and then jumps over
+		// more defer statements, which must never run.
+		return B().DeferStep().Call(&Goto{ID: f.id(), Body: f.sub()}).Append(f.sub()).Build(), Defer
+	case 5:
+		g := &Global{Init: f.rand.Intn(10)}
+		for n := 1 + f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			g.Ops = append(g.Ops, &GlobalOp{Add: 1 + f.rand.Intn(9)})
+		}
+		return g, Defer
+	case 6:
+		// The recover-to-error idiom. The function must not be
+		// deferred, as its steps happen when it's called.
+		e := &ErrResult{ID: f.id(), Bad: f.rand.Intn(4) == 0}
+		b := B()
+		for n := f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			if f.rand.Intn(2) == 0 {
+				b.DeferStep()
+			} else {
+				b.Step()
+			}
+		}
+		box := "errval"
+		if e.Bad {
+			box = ""
+		}
+		e.Body = b.Call(&Unit{Kind: Panic, N: -1, Box: box}).Build()
+		return e, false
+	case 7:
+		return &Args{}, Defer
+	case 8:
+		// A function whose last statement panics after registering
+		// several defers, all of which must run.
+		b := B()
+		for n := 2 + f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			if f.rand.Intn(2) == 0 {
+				b.DeferStep()
+			} else {
+				b.Defer(f.sub())
+			}
+		}
+		return b.Panic(-1).Build(), Defer
+	case 9:
+		// A function whose deferred call recovers its panic and then
+		// calls a function that panics anew, which must propagate.
+		d := B().Recover().Call(B().Append(f.sub()).Panic(-1))
+		return B().Defer(d).Append(f.sub()).Panic(-1).Build(), Defer
+	case 10:
+		return &Filter{}, true
+	case 11:
+		// A panic that unwinds through several functions, running
+		// their defers, before a distant deferred call recovers it.
+		b := B().DeferStep().Panic(-1)
+		for n := 2 + f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			b = B().Recover().DeferStep().Defer(B().Step()).Call(b)
+		}
+		return B().Defer(B().Recover()).Call(b).Step().Build(), Defer
+	case 12:
+		// A switch, type switch, or select statement whose arms
+		// register defers in the enclosing function, and maybe
+		// panic. Only the arm taken may register any.
+		s := &Switch{Kind: SwitchKind(f.rand.Intn(3))}
+		for n := 1 + f.rand.Intn(len(typeCases)+1); n > 0; n-- {
+			b := B()
+			for n := f.rand.Intn(3); n > 0 && f.budget > 0; n-- {
+				f.budget--
+				if f.rand.Intn(2) == 0 {
+					b.DeferStep()
+				} else {
+					b.Defer(f.sub())
+				}
+			}
+			if f.rand.Intn(2) == 0 {
+				b.Panic(-1)
+			}
+			s.Arms = append(s.Arms, b.Build())
+		}
+		s.Case = f.rand.Intn(len(s.Arms))
+		return s, false
+	case 13:
+		return &ChanRecover{Body: B().Append(f.sub()).Panic(-1).Build()}, Defer
+	case 14:
+		// A function that starts goroutines, which must not
+		// panic, and waits for them to finish, one at a time,
+		// before continuing. Their recovers only see their own
+		// panics, even if this function is deferred.
+		fork := &Fork{WaitGroup: f.rand.Intn(2) == 0}
+		for n := 1 + f.rand.Intn(3); n > 0; n-- {
+			if f.rand.Intn(2) == 0 {
+				fork.Bodies = append(fork.Bodies, f.recovering())
+			} else {
+				fork.Bodies = append(fork.Bodies, B().Defer(B().Recover()).Append(f.stepping()).Build())
+			}
+		}
+		pre := B()
+		for n := f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			if f.rand.Intn(2) == 0 {
+				pre.DeferStep()
+			} else {
+				pre.Step()
+			}
+		}
+		fork.Pre, fork.Post = pre.Build(), f.sub()
+		return fork, Defer
+	case 15:
+		r := &RangeFunc{ID: f.id(), Iters: 1 + f.rand.Intn(4), IterDefers: make([]int, f.rand.Intn(3))}
+		if f.rand.Intn(2) == 0 {
+			r.PanicAt = f.rand.Intn(r.Iters)
+			r.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		if f.lang < 23 {
+			return new(Multi), Defer
+		}
+		return r, Defer
+	case 16:
+		return &Loop{Body: B().DeferStep().Append(f.sub()).Build()}, false
+	case 17:
+		// Defers in only one branch, so whether each open-coded
+		// defer runs must be tracked at run time.
+		return &If{
+			Cond: f.rand.Intn(2) == 0,
+			Then: B().DeferStep().Append(f.sub()).Build(),
+			Else: B().DeferStep().Append(f.sub()).Build(),
+		}, false
+	case 18:
+		// A function that can't use open-coded defers, because it
+		// has too many defer statements or one of them is in a
+		// loop, but otherwise could.
+		b := B()
+		n, loop := maxOpenDefers+1+f.rand.Intn(8), f.rand.Intn(2) == 0
+		if loop {
+			n = f.rand.Intn(maxOpenDefers)
+		}
+		for ; n > 0; n-- {
+			f.budget--
+			if f.rand.Intn(4) == 0 {
+				b.Defer(f.sub())
+			} else {
+				b.DeferStep()
+			}
+		}
+		if loop {
+			b.Call(&Loop{Body: B().DeferStep().Build()})
+		}
+		return b.Append(f.sub()).Build(), Defer
+	case 19:
+		return &Func{ID: f.id(), Body: f.sub()}, Defer
+	case 20:
+		return &Capture{Step: &Unit{Kind: Normal, N: -1}, Lit: f.rand.Intn(2) == 0}, false
+	case 21:
+		r := &Rebind{Step: &Unit{Kind: Normal, N: -1}}
+		if f.rand.Intn(2) == 0 {
+			r.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		return r, false
+	case 22:
+		return &NilDefer{Body: f.sub()}, Defer
+	case 23:
+		return &NilRecover{Direct: f.rand.Intn(2) == 0}, true
+	case 24:
+		// A function that panics and then runs deferred calls that
+		// each panic while it's unwinding from the previous panic,
+		// superseding it. Only the last panic is recovered.
+		b := B().Defer(B().Recover())
+		for n := 1 + f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			switch f.rand.Intn(3) {
+			case 0:
+				b.DeferPanic()
+			case 1:
+				b.Defer(B().Append(f.sub()).Panic(-1))
+			case 2:
+				b.DeferStep()
+			}
+		}
+		return b.Panic(-1).Build(), Defer
+	case 25:
+		// A function whose deferred call recovers its panic and
+		// immediately panics anew, so that the function's callers
+		// see the new panic instead. (Filter repanics with the
+		// recovered value.)
+		repanic := B().Recover().Call(&Unit{Kind: Panic, N: -1, Box: boxes[f.rand.Intn(len(boxes))]})
+		return B().Defer(repanic).Append(f.sub()).Panic(-1).Build(), Defer
+	case 26:
+		b := f.stepping()
+		if f.lang < 21 {
+			return new(Multi), Defer
+		}
+		return &PanicNil{Body: b}, Defer
+	case 27:
+		return &Fault{Kind: f.rand.Intn(len(faults)), Body: f.stepping()}, Defer
+	case 28:
+		// A goroutine that exits from a nested call, running the
+		// deferred calls of both, whose recovers must return nil.
+		inner := B().Defer(B().Recover()).Append(f.stepping())
+		if f.rand.Intn(2) == 0 {
+			inner.Defer(f.recovering())
+		}
+		outer := B().Defer(B().Recover()).Append(f.stepping())
+		return &Goexit{Outer: outer.Build(), Inner: inner.Build()}, Defer
+	case 29:
+		// A function that returns from the middle of its body,
+		// maybe conditionally, and so begins running its deferred
+		// calls without a panic. The rest of its body must not run.
+		ret := B().Return()
+		if f.rand.Intn(2) == 0 {
+			ret = B().Call(&If{Cond: true, Then: ret.Build(), Else: f.stepping()})
+			if f.rand.Intn(2) == 0 {
+				ret = B().Call(&If{Cond: false, Then: f.stepping(), Else: ret.Build()})
+			}
+		}
+		body := B().Append(f.sub()).Append(ret.Build()).Append(f.sub()).Build()
+		if f.rand.Intn(2) == 0 {
+			return &Func{ID: f.id(), Body: body}, Defer
+		}
+		return body, Defer
+	case 30:
+		// A labeled loop that registers defers in each iteration
+		// and leaves it with continue, and the loop with break or
+		// goto, from within an inner loop. The defers after each
+		// jump must never be registered.
+		l := &Labeled{ID: f.id(), Goto: f.rand.Intn(2) == 0}
+		for n := 1 + f.rand.Intn(3); n > 0; n-- {
+			b := B()
+			for n := f.rand.Intn(3); n > 0 && f.budget > 0; n-- {
+				f.budget--
+				if f.rand.Intn(2) == 0 {
+					b.DeferStep()
+				} else {
+					b.Defer(f.sub())
+				}
+			}
+			b.Step()
+			l.Iters = append(l.Iters, b.Build())
+		}
+		l.Skipped = f.stepping()
+		return l, false
+	case 31:
+		// A generic function, or a method of a generic type, that
+		// defers calls in each of its instantiations, with type
+		// arguments of different shapes so that they're called
+		// with dictionaries. Generic functions can only declare
+		// types, to prevent inlining, since Go 1.20.
+		g := &Generic{ID: f.id(), Method: f.rand.Intn(2) == 0}
+		for n := 1 + f.rand.Intn(3); n > 0; n-- {
+			g.Types = append(g.Types, f.rand.Intn(len(genericTypes)))
+			g.Arms = append(g.Arms, f.sub())
+		}
+		if f.lang < 20 {
+			return new(Multi), Defer
+		}
+		return g, Defer
+	case 32:
+		// A recursion deep enough to grow the stack, and so move
+		// the deferred closures, and what they refer to, of the
+		// frames below.
+		r := &Recurse{ID: f.id(), Depth: 1 << (4 + f.rand.Intn(8))}
+		if f.rand.Intn(2) == 0 {
+			r.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		return r, Defer
+	case 33:
+		l := &Locals{Init: [2]int{f.rand.Intn(10), f.rand.Intn(10)}}
+		for n := 1 + f.rand.Intn(5); n > 0 && f.budget > 0; n-- {
+			f.budget--
+			l.Ops = append(l.Ops, &LocalOp{Var: f.rand.Intn(2), Add: 1 + f.rand.Intn(9), Defer: f.rand.Intn(2) == 0})
+		}
+		return l, Defer
+	case 34:
+		// A loop whose iterations each defer a closure that refers
+		// to the loop variable, which is per-iteration as of Go 1.22,
+		// and shared by all of them before that, unless copied.
+		// Without -lang, the semantics depend on the toolchain, so
+		// it's copied.
+		l := &LoopVar{N: 1 + f.rand.Intn(4), Range: f.rand.Intn(2) == 0, Copy: f.rand.Intn(4) == 0 || f.lang == 0}
+		l.Shared = !l.Copy && f.lang < 22
+		return l, Defer
+	case 35:
+		// A function that defers calls of builtins, which aren't
+		// real functions, and changes their operands before they
+		// run. The clear builtin is new in Go 1.21, so it's dropped
+		// afterwards for older versions.
+		b := new(Builtins)
+		for _, k := range []Builtin{DeferClose, DeferDelete, DeferClear, DeferCopy, DeferPrint} {
+			if f.rand.Intn(2) == 0 {
+				continue
+			}
+			i := f.rand.Intn(len(b.Defers) + 1)
+			b.Defers = append(b.Defers[:i], append([]Builtin{k}, b.Defers[i:]...)...)
+		}
+		if f.lang < 21 {
+			var defers []Builtin
+			for _, k := range b.Defers {
+				if k != DeferClear {
+					defers = append(defers, k)
+				}
+			}
+			b.Defers = defers
+		}
+		if f.rand.Intn(2) == 0 {
+			b.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		return b, Defer
+	case 36:
+		// A function that defers a call of a variadic closure, with
+		// some elements of a slice or the slice spread, and then
+		// changes the slice.
+		v := &Variadic{Len: f.rand.Intn(4), Spread: f.rand.Intn(2) == 0}
+		if !v.Spread {
+			v.Args = f.rand.Intn(v.Len + 1)
+		}
+		if f.rand.Intn(2) == 0 {
+			v.Panic = &Unit{Kind: Panic, N: -1}
+		}
+		return v, Defer
+	default:
+		// An immediately invoked function literal that handles its
+		// own panic without affecting the calling frame.
+		return f.recovering(), false
+	}
+}
+
+// recovering returns a Multi that panics at the end of a random body,
+// and recovers the panic in a call it deferred.
+func (f *Fuzzer) recovering() *Multi {
+	return B().Defer(B().Recover()).DeferStep().Append(f.sub()).Panic(-1).Build()
+}
+
+// insert inserts a call of c at a random point in m.
+func (f *Fuzzer) insert(m *Multi, c interface{}) {
+	var ms []*Multi
+	first := make(map[*Multi]int) // the first index c may be inserted at
+	walk(m, func(m *Multi) {
+		ms = append(ms, m)
+		for j, stmt := range m.Body {
+			if _, ok := stmt.Call.(*Init); ok {
+				first[m] = j + 1 // main can't run before init
+			}
+		}
+	})
+	m = ms[f.rand.Intn(len(ms))]
+	i := f.rand.Intn(len(m.Body) + 1)
+	if i < first[m] {
+		i = first[m]
+	}
+	if i > 0 && i == len(m.Body) {
+		// Keep a panic at the end, which may be a function's
+		// terminating statement.
+		if u, ok := m.Body[i-1].Call.(*Unit); ok && u.Kind == Panic && !m.Body[i-1].Defer {
+			i--
+		}
+	}
+	m.Body = append(m.Body[:i], append([]*Stmt{{Call: c}}, m.Body[i:]...)...)
+}
+
+// stepping returns a Multi of a few steps and deferred steps.
+func (f *Fuzzer) stepping() *Multi {
+	b := B()
+	for n := f.rand.Intn(4); n > 0 && f.budget > 0; n-- {
+		f.budget--
+		if f.rand.Intn(2) == 0 {
+			b.DeferStep()
+		} else {
+			b.Step()
+		}
+	}
+	return b.Build()
+}
+
+// id returns a new ID for a top-level declaration.
+func (f *Fuzzer) id() int {
+	f.ids++
+	return f.ids
+}
+
+type Stmt struct {
+	Note  string // simulated effect, set by Run
+	Defer bool
+	Call  interface{} // *Unit, *Multi, or one of the types made by Fuzzer.extra
+}
+
+type Kind int
+
+const (
+	Normal Kind = iota
+	Recover
+	Panic
+)
+
+type Unit struct {
+	Kind Kind
+	N    int
+	Box  string // for Panic, the support function wrapping N, if any
+}
+
+// boxes lists the support functions that wrap panic values.
+var boxes = []string{"", "chanval", "mapval", "errval", "strval", "pairval", "ptrval", "ifaceval"}
+
+type Multi struct {
+	Body []*Stmt
+}
+
+// children returns the Multis nested directly within call.
+func children(call interface{}) []*Multi {
+	switch c := call.(type) {
+	case *Multi:
+		return []*Multi{c}
+	case *Closure:
+		return []*Multi{c.Body}
+	case *Func:
+		return []*Multi{c.Body}
+	case *NilDefer:
+		return []*Multi{c.Body}
+	case *PanicNil:
+		return []*Multi{c.Body}
+	case *Fault:
+		return []*Multi{c.Body}
+	case *Goto:
+		return []*Multi{c.Body}
+	case *ErrResult:
+		return []*Multi{c.Body}
+	case *Switch:
+		return c.Arms
+	case *Loop:
+		return []*Multi{c.Body}
+	case *Labeled:
+		return append(c.Iters[:len(c.Iters):len(c.Iters)], c.Skipped)
+	case *If:
+		return []*Multi{c.Then, c.Else}
+	case *ChanRecover:
+		return []*Multi{c.Body}
+	case *Fork:
+		return append([]*Multi{c.Pre, c.Post}, c.Bodies...)
+	case *Crash:
+		return []*Multi{c.Body}
+	case *Generic:
+		return c.Arms
+	case *Init:
+		return []*Multi{c.Body}
+	case *Goexit:
+		return []*Multi{c.Outer, c.Inner}
+	}
+	return nil
+}
+
+// height returns the number of levels of Multis nested within call.
+func height(call interface{}) int {
+	h := 0
+	for _, c := range children(call) {
+		for _, stmt := range c.Body {
+			if ch := 1 + height(stmt.Call); ch > h {
+				h = ch
+			}
+		}
+		if h == 0 {
+			h = 1
+		}
+	}
+	return h
+}
+
+// A Result is a call to a top-level function with named result r.
+// The function defers a closure for each of Adds, which sets
+// r = r*10 + Add, then sets r to Init and returns, or panics with
+// Panic, which the first deferred closure recovers before updating r.
+// Either way, the caller observes r after all the closures.
+type Result struct {
+	ID    int
+	Init  int
+	Adds  []int
+	Panic *Unit
+	Want  int
+}
+
+// A Closure is a call to a closure returned by a top-level function.
+// The closure captures a local X of its creator, and runs Body only
+// when invoked, after its creator has returned.
+type Closure struct {
+	ID   int
+	X    int
+	Body *Multi
+}
+
+// A Func is a call to a top-level function with body Body, rather
+// than to a function literal.
+type Func struct {
+	ID   int
+	Body *Multi
+}
+
+// A Recv is a call to a closure that defers value- and pointer-receiver
+// method calls on a local t of type T, assigning to t.n before each.
+// The methods are called directly, through interfaces, or as method
+// expressions.
+// Value receivers see t.n as of the defer statement; pointer receivers
+// see Final, the value assigned after the last defer statement.
+type Recv struct {
+	Ops   []*RecvOp
+	Final int
+}
+
+type RecvOp struct {
+	Ptr  bool // defer t.P instead of t.V
+	Via  int  // 0 for a method call, 1 through an interface, 2 for a method expression
+	Val  int  // assigned to t.n before deferring
+	N    int
+	Want int
+}
+
+// call returns the deferred method call.
+func (op *RecvOp) call() string {
+	switch {
+	case op.Via == 1 && op.Ptr:
+		return fmt.Sprintf("Per(&t).P(%v, %v)", op.N, op.Want)
+	case op.Via == 1:
+		return fmt.Sprintf("Ver(t).V(%v, %v)", op.N, op.Want)
+	case op.Via == 2 && op.Ptr:
+		return fmt.Sprintf("(*T).P(&t, %v, %v)", op.N, op.Want)
+	case op.Via == 2:
+		return fmt.Sprintf("T.V(t, %v, %v)", op.N, op.Want)
+	case op.Ptr:
+		return fmt.Sprintf("t.P(%v, %v)", op.N, op.Want)
+	}
+	return fmt.Sprintf("t.V(%v, %v)", op.N, op.Want)
+}
+
+// A Goto is a goto statement that jumps over Body, which is written
+// inline in the enclosing function but never executed.
+type Goto struct {
+	ID   int
+	Body *Multi
+}
+
+// A Global is a call to a closure that sets the package-level
+// variable g to Init and defers closures that each check g and then
+// update it. Final is the value of g after all of them have run.
+type Global struct {
+	Init  int
+	Ops   []*GlobalOp
+	Final int
+}
+
+type GlobalOp struct {
+	Add  int // g = g*10 + Add
+	Want int // g as observed by this deferred call
+}
+
+// A Builtins is a call to a closure that defers calls to each of
+// Defers, which are builtins, then changes their operands, and then
+// returns, or panics with Panic. A deferred closure, which runs after
+// them, checks their effects, including that the map, if any, has Len
+// entries.
+type Builtins struct {
+	Defers []Builtin
+	Panic  *Unit
+	Len    int
+}
+
+// A Builtin is a builtin function that can be deferred.
+type Builtin int
+
+const (
+	DeferClose  Builtin = iota // close a buffered channel, after a send
+	DeferDelete                // delete one of two map entries
+	DeferClear                 // clear the same map
+	DeferCopy                  // copy from a slice, whose element changes
+	DeferPrint                 // print an empty line
+)
+
+// A Variadic is a call to a closure that makes a slice s of Len
+// elements, defers a call of a variadic closure that steps N, and then
+// changes the first element of s, reassigns s, and returns or panics
+// with Panic. If Spread, the deferred call passes s..., sharing its
+// elements; otherwise it passes the first Args elements of s, copied,
+// and no arguments must make a nil slice.
+type Variadic struct {
+	N      int
+	Len    int
+	Args   int
+	Spread bool
+	Panic  *Unit
+}
+
+// want returns the arguments the deferred call in v must see.
+func (v *Variadic) want() []int {
+	want := []int{}
+	if v.Spread {
+		for i := 0; i < v.Len; i++ {
+			want = append(want, 10*(i+1))
+		}
+		if v.Len > 0 {
+			want[0] = -1
+		}
+		return want
+	}
+	for i := 0; i < v.Args; i++ {
+		want = append(want, 10*(i+1))
+	}
+	return want
+}
+
+// A LoopVar is a call to a closure with a loop of N iterations, a
+// three-clause for loop or, if Range, a range loop, over i, each of
+// which defers a closure that steps, First onward in the order they
+// run, and checks i. If Copy, the iteration copies i to a new i first.
+// If Shared, i is shared by all the iterations, as before Go 1.22, and
+// the closures see its final value.
+type LoopVar struct {
+	N      int
+	Range  bool
+	Copy   bool
+	Shared bool
+	First  int
+}
+
+// A Locals is a call to a closure with local variables a and b, set
+// to Init, that calls closures, or defers them, that each check one of
+// the variables and then update it. It also defers a check of their
+// final values, Final.
+type Locals struct {
+	Init  [2]int
+	Ops   []*LocalOp
+	Final [2]int
+}
+
+type LocalOp struct {
+	Var   int // 0 for a, 1 for b
+	Add   int // v = v*10 + Add
+	Defer bool
+	Want  int // v as observed by this call
+}
+
+// An ErrResult is a call to a top-level function with named result
+// err, which recovers the panic at the end of Body and assigns it to
+// err with a type assertion. If Bad, the panic value is not an error
+// and the type assertion panics.
+type ErrResult struct {
+	ID   int
+	Body *Multi
+	Bad  bool
+	Want int
+}
+
+// A Return is a return statement, which ends the function executing
+// it early. Its deferred calls then run, without a panic.
+type Return struct{}
+
+// An Exit is a call of os.Exit(0), after N steps. No deferred calls
+// may run after it.
+type Exit struct {
+	N int
+}
+
+// exited returns the Exit that m reaches, if any.
+func exited(m *Multi) *Exit {
+	var e *Exit
+	walk(m, func(m *Multi) {
+		for _, stmt := range m.Body {
+			if x, ok := stmt.Call.(*Exit); ok && x.N >= 0 {
+				e = x
+			}
+		}
+	})
+	return e
+}
+
+// An Args is a call to step3 with three arguments that each step,
+// left to right, when the call or defer statement is executed.
+type Args struct {
+	N    int
+	Args [3]int
+}
+
+// A Capture is a block that assigns Step's number to a local x, defers
+// a call of step with argument x, and then assigns x a wrong number.
+// The deferred call must see x as of the defer statement. If Lit, the
+// deferred call is to a function literal with parameter x.
+type Capture struct {
+	Step *Unit
+	Lit  bool
+}
+
+// A Fault is a call to a closure that executes Body, which only steps,
+// and then a statement that makes the runtime panic, as listed in
+// faults. A deferred call checks the run-time error it recovers, and
+// panics with N instead.
+type Fault struct {
+	Kind int // index in faults
+	Body *Multi
+	N    int
+}
+
+// faults lists statements that make the runtime panic, and the
+// messages of their run-time errors.
+var faults = []struct{ stmt, msg string }{
+	{"*nilptr = 1", "nil pointer dereference"},
+	{"small[zero] = 1", "index out of range"},
+	{"zero = 1 / zero", "integer divide by zero"},
+	{"nilmap[0] = 1", "assignment to entry in nil map"},
+	{"_ = iface.(int)", "interface conversion"},
+}
+
+// A PanicNil is a call to a closure that executes Body, which only
+// steps, and then calls panic(nil). A deferred call checks that the
+// panic is recovered as a *runtime.PanicNilError, or as nil if
+// GODEBUG=panicnil=1 restores the behavior from before Go 1.21.
+type PanicNil struct {
+	Body *Multi
+}
+
+// A NilRecover is a deferred call that recovers nothing, even while
+// panicking, because recover isn't called directly by the deferred
+// function: a deferred closure checks that a helper function's call of
+// recover returns nil.
+//
+// If Direct, recover itself is deferred instead. That recovers nothing
+// if the function panics, but if the function is a deferred call and
+// returns normally, recover is called directly by it, and recovers the
+// panic that called it.
+type NilRecover struct {
+	Direct bool
+}
+
+// A NilDefer is a call to a closure that defers a call of a nil
+// function and then executes Body. The call panics only when it's
+// executed, superseding any panic from Body, and another deferred call
+// recovers the run-time error and panics with N instead.
+type NilDefer struct {
+	Body *Multi
+	N    int
+}
+
+// A Rebind is a block that assigns a function literal calling Step to
+// a local fn, defers a call of fn, and then assigns fn a function that
+// fails. The deferred call must call the function as of the defer
+// statement, even when the block then panics with Panic, if non-nil.
+type Rebind struct {
+	Step  *Unit
+	Panic *Unit
+}
+
+// A Filter is a call to a closure that recovers the panic with id N,
+// if any, and propagates it again unless N is even.
+type Filter struct {
+	N int
+}
+
+// A Switch is a switch, type switch, or select statement with an arm
+// for each of Arms, the last of which is the default case. Only the
+// arm numbered Case is taken, which executes in the enclosing function.
+type Switch struct {
+	Kind SwitchKind
+	Arms []*Multi
+	Case int
+}
+
+// A SwitchKind is a kind of Switch.
+type SwitchKind int
+
+const (
+	ExprSwitch   SwitchKind = iota // switch on an element of ints, which is its index
+	TypeSwitch                     // type switch on an element of values
+	SelectSwitch                   // select receiving from closed or block
+)
+
+// typeCases lists the types of the non-nil values of the generated
+// program's values, in order, for TypeSwitch.
+var typeCases = []string{"int", "string", "pair", "error"}
+
+// A Loop is a for loop that executes Body in the enclosing function
+// and then breaks. Because they're in a loop, the defer statements in
+// Body are heap-allocated rather than open-coded or stack-allocated.
+type Loop struct {
+	Body *Multi
+}
+
+// A Labeled is a loop labeled L<ID>, whose iteration i executes
+// Iters[i] in the enclosing function from within an inner loop, and
+// then continues the labeled loop. The last iteration breaks out of it
+// instead, or if Goto, jumps past it. Skipped, which follows the jumps
+// in the inner loop, is never executed.
+type Labeled struct {
+	ID      int
+	Iters   []*Multi
+	Goto    bool
+	Skipped *Multi
+}
+
+// An If is an if statement that executes Then or Else, depending on
+// Cond, in the enclosing function. Cond is a variable, so the compiler
+// can't tell which of their defer statements are executed.
+type If struct {
+	Cond       bool
+	Then, Else *Multi
+}
+
+// A ChanRecover is a call to a closure that executes Body, recovers
+// the resulting panic with id N in one deferred call, and sends it on
+// a channel to another deferred call that checks it.
+type ChanRecover struct {
+	N    int
+	Body *Multi
+}
+
+// A Fork is a call to a closure that starts a goroutine executing
+// each of Bodies, executes Pre, lets the goroutines run one at a time,
+// waits for them to finish, with a sync.WaitGroup if WaitGroup, and
+// then executes Post. Bodies must not panic, and Pre must not panic or
+// recover.
+//
+// The goroutines run in a fixed order, passed along a chain of
+// channels, by design: every step checks a single counter against the
+// total order computed by Run, so a trace is either right or wrong,
+// and a failure replays the same way. Defers are per goroutine, so
+// interleaving the bodies would mostly exercise the scheduler, and
+// comparing traces as partial orders instead would weaken the checks
+// of the defers within each body.
+type Fork struct {
+	Pre, Post *Multi
+	Bodies    []*Multi
+	WaitGroup bool
+}
+
+// frame returns the equivalent Multi with the goroutines' execution
+// in place of the join.
+func (c *Fork) frame() *Multi {
+	b := B().Append(c.Pre)
+	for _, body := range c.Bodies {
+		b.Call(body)
+	}
+	return b.Append(c.Post).Build()
+}
+
+// A Bulk is a call to a function literal that registers Defers
+// deferred steps, First onward in the order they run, either in
+// straight-line code or in a loop, and then returns, or panics with
+// Panic. They're for -bulk-defers, to stress the runtime's handling
+// of long chains of defer records.
+type Bulk struct {
+	Defers int
+	Loop   bool
+	First  int
+	Panic  *Unit
+}
+
+// A Recurse is a call to a closure that defers a step, Top, and calls
+// a recursive function r<ID>, which recurses to Depth levels, deferring
+// a closure at each that checks its locals, and those of its caller, were
+// moved with the stack. At the bottom, it steps, Bottom, and maybe
+// panics with Panic.
+type Recurse struct {
+	ID          int
+	Depth       int
+	Bottom, Top int
+	Panic       *Unit
+}
+
+// An Init is an init function executing Body, which recovers its own
+// panics. Inits are at the start of main, before any other calls, as
+// they run first.
+type Init struct {
+	Body *Multi
+}
+
+// A Generic is a call to a closure that calls a generic function
+// g<ID>, or the method call of a generic type G<ID>, instantiated with
+// each of Types, which index genericTypes, in turn. Instantiation i
+// executes Arms[i], after deferring a check that the value of its
+// type argument it was passed is captured by the deferred call.
+type Generic struct {
+	ID     int
+	Method bool
+	Types  []int
+	Arms   []*Multi
+}
+
+// genericTypes lists the type arguments of Generic, with a value of
+// each. Their GC shapes differ.
+var genericTypes = []struct{ typ, val string }{
+	{"int", "7"},
+	{"string", `"s"`},
+	{"pair", "pair{1, 2}"},
+	{"*int", "&g"},
+	{"error", "errval(1)"},
+	{"interface{}", "pair{3, 4}"},
+}
+
+// A Crash is a call to a closure that starts a goroutine and blocks
+// forever. The goroutine executes Body and then panics with Panic,
+// which isn't recovered, so the program crashes after Steps steps
+// without running any other deferred calls. The goroutine announces
+// the crash with a deferred call of crashed.
+type Crash struct {
+	Body  *Multi
+	Panic *Unit
+	Steps int
+}
+
+// frame returns the Multi executed by the goroutine.
+func (c *Crash) frame() *Multi {
+	return B().Append(c.Body).Call(c.Panic).Build()
+}
+
+// A Goexit is a call to a closure that starts a goroutine and waits
+// for it to exit. The goroutine executes Outer, and then calls a
+// function that executes Inner and calls runtime.Goexit. Neither may
+// panic.
+type Goexit struct {
+	Outer, Inner *Multi
+}
+
+// frame returns the equivalent Multi, as far as the deferred calls
+// that Goexit runs are concerned.
+func (c *Goexit) frame() *Multi {
+	return B().Append(c.Outer).Call(c.Inner).Build()
+}
+
+// A RangeFunc is a call to a closure containing a range-over-func loop.
+// The iterator defers len(IterDefers) steps and then yields Iters
+// values. Each iteration of the loop body defers a step and steps,
+// and iteration PanicAt panics if Panic is non-nil.
+type RangeFunc struct {
+	ID         int
+	Iters      int
+	IterDefers []int // steps deferred by the iterator, in order
+	PanicAt    int
+	Panic      *Unit
+
+	First int // the loop body's step in the first iteration
+	Last  int // the loop body's deferred step from the first iteration
 }
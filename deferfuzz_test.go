@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runTree runs m with Run, as a function called by main, and returns
+// the panic that escapes it and the steps and recovers it simulated.
+func runTree(m *Multi) (int, []string) {
+	simMu.Lock()
+	defer simMu.Unlock()
+	steps, panics, events = 0, 0, nil
+	panicBoxes = make(map[int]string)
+	escaped := Run(m, new(int))
+	return escaped, events
+}
+
+var runTests = []struct {
+	name    string
+	m       *Multi
+	escaped int
+	events  []string
+}{
+	{
+		name:    "steps",
+		m:       B().Step().DeferStep().Step().Build(),
+		escaped: 0,
+		events:  []string{"step 1", "step 2", "step 3"},
+	},
+	{
+		name:    "panic escapes",
+		m:       B().DeferStep().Step().Panic(1).Step().Build(),
+		escaped: 1,
+		events:  []string{"step 1", "step 2"},
+	},
+	{
+		name:    "deferred recover",
+		m:       B().Defer(B().Recover()).Panic(1).Build(),
+		escaped: 0,
+		events:  []string{"recover 1"},
+	},
+	{
+		name:    "recover without panic",
+		m:       B().Defer(B().Recover()).Step().Build(),
+		escaped: 0,
+		events:  []string{"step 1", "recover 0"},
+	},
+	{
+		name:    "recover in nested function",
+		m:       B().Call(B().Defer(B().Recover()).Panic(1)).Step().Build(),
+		escaped: 0,
+		events:  []string{"recover 1", "step 1"},
+	},
+	{
+		// The inner deferred call runs as the outer one returns,
+		// not because of the panic, so it can't recover it.
+		name:    "recover in nested defer",
+		m:       B().Defer(B().Defer(B().Recover()).Step()).Panic(1).Build(),
+		escaped: 1,
+		events:  []string{"step 1", "recover 0"},
+	},
+	{
+		name:    "repanic after recover",
+		m:       B().Defer(B().Recover()).Defer(B().Recover().Panic(2)).Panic(1).Build(),
+		escaped: 0,
+		events:  []string{"recover 1", "recover 2"},
+	},
+	{
+		name:    "repanic escapes",
+		m:       B().DeferStep().Defer(B().Recover().Panic(2)).Panic(1).Build(),
+		escaped: 2,
+		events:  []string{"recover 1", "step 1"},
+	},
+	{
+		name:    "deferred panic supersedes",
+		m:       B().Defer(B().Recover()).Defer(B().Panic(2)).Panic(1).Build(),
+		escaped: 0,
+		events:  []string{"recover 2"},
+	},
+	{
+		name: "goexit",
+		m: B().Call(&Goexit{
+			Outer: B().DeferStep().Defer(B().Recover()).Build(),
+			Inner: B().DeferStep().Step().Build(),
+		}).Step().Build(),
+		escaped: 0,
+		events:  []string{"step 1", "step 2", "recover 0", "step 3", "step 4"},
+	},
+	{
+		name:    "nil func defer",
+		m:       B().Defer(B().Recover()).Call(&NilDefer{Body: B().Step().Build()}).Build(),
+		escaped: 0,
+		events:  []string{"step 1", "recover 1"},
+	},
+	{
+		name:    "nil func defer supersedes panic",
+		m:       B().Defer(B().Recover()).Call(&NilDefer{Body: B().Panic(1).Build()}).Build(),
+		escaped: 0,
+		events:  []string{"recover 2"},
+	},
+}
+
+func TestRun(t *testing.T) {
+	for _, tt := range runTests {
+		// Run renumbers the panics, so note the numbers they
+		// were built with first.
+		want := make(map[*Unit]int)
+		walk(tt.m, func(m *Multi) {
+			for _, stmt := range m.Body {
+				if u, ok := stmt.Call.(*Unit); ok && u.Kind == Panic && u.N >= 0 {
+					want[u] = u.N
+				}
+			}
+		})
+
+		escaped, events := runTree(tt.m)
+		if escaped != tt.escaped {
+			t.Errorf("%v: panic %v escaped, want %v", tt.name, escaped, tt.escaped)
+		}
+		if !reflect.DeepEqual(events, tt.events) {
+			t.Errorf("%v: events %q, want %q", tt.name, events, tt.events)
+		}
+		for u, n := range want {
+			if u.N != n {
+				t.Errorf("%v: Run numbered panic %v as %v", tt.name, n, u.N)
+			}
+		}
+	}
+}
+
+// setFlag sets the flag name to value for the rest of test t.
+func setFlag(t *testing.T, name, value string) {
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	for _, lang := range []string{"", "go1.20", "go1.23"} {
+		setFlag(t, "lang", lang)
+		for seed := int64(1); seed <= 50; seed++ {
+			m1, buf1 := generate(seed)
+			m2, buf2 := generate(seed)
+			if !bytes.Equal(buf1, buf2) {
+				t.Errorf("-lang %q, seed %v: programs differ", lang, seed)
+			}
+			if !reflect.DeepEqual(m1, m2) {
+				t.Errorf("-lang %q, seed %v: call trees differ", lang, seed)
+			}
+		}
+	}
+}
+
+// TestLangDecisions checks that -lang doesn't change the random
+// decisions made building a call tree, only which constructs are
+// dropped afterwards.
+func TestLangDecisions(t *testing.T) {
+	decisions := func(seed int64) []int {
+		rec := &recorder{r: rand.New(rand.NewSource(seed))}
+		build(rec)
+		return rec.log
+	}
+	for seed := int64(1); seed <= 200; seed++ {
+		setFlag(t, "lang", "")
+		want := decisions(seed)
+		for _, lang := range []string{"go1.20", "go1.21", "go1.22", "go1.23"} {
+			setFlag(t, "lang", lang)
+			if have := decisions(seed); !reflect.DeepEqual(have, want) {
+				t.Errorf("seed %v: -lang %v changes the decisions", seed, lang)
+			}
+		}
+	}
+}
+
+// TestReadGenerated checks that readGenerated recovers how a program
+// was generated, from a seed or a decision log, from its header.
+func TestReadGenerated(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.go")
+	log := filepath.Join(dir, "decisions.txt")
+
+	setFlag(t, "max-depth", "3")
+	setFlag(t, "os-exit", "true")
+	_, seeded := generate(7)
+	if err := writeDecisions(log, 7); err != nil {
+		t.Fatal(err)
+	}
+	_, replayed := regenerate(log)
+
+	for _, buf := range [][]byte{seeded, replayed} {
+		if err := ioutil.WriteFile(file, buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+		setFlag(t, "max-depth", "0")
+		setFlag(t, "os-exit", "false")
+		seed, decisions, _ := readGenerated(file)
+		if d := flag.Lookup("max-depth").Value.String(); d != "3" {
+			t.Errorf("readGenerated set -max-depth %v, want 3", d)
+		}
+		if e := flag.Lookup("os-exit").Value.String(); e != "true" {
+			t.Errorf("readGenerated set -os-exit %v, want true", e)
+		}
+		if decisions == "" {
+			if seed != 7 {
+				t.Errorf("readGenerated returned seed %v, want 7", seed)
+			}
+			if _, regen := generate(seed); !bytes.Equal(regen, seeded) {
+				t.Error("program regenerated from seed differs")
+			}
+			continue
+		}
+		if decisions != log {
+			t.Errorf("readGenerated returned decision log %q, want %q", decisions, log)
+		}
+		if _, regen := regenerate(decisions); !bytes.Equal(regen, replayed) {
+			t.Error("program regenerated from decision log differs")
+		}
+	}
+}
+
+// setWeights sets the generator's weights to w for the rest of test t.
+func setWeights(t *testing.T, w Weights) {
+	old := weights()
+	weightsVal = w
+	t.Cleanup(func() { weightsVal = old })
+}
+
+// TestProgramFormats checks that the programs generated with weights
+// that favor each kind of call are well-formed, so that constructs
+// nested in unusual places, like labels at the end of a case, are
+// exercised.
+func TestProgramFormats(t *testing.T) {
+	favor := map[string]func(w *Weights){
+		"defer":   func(w *Weights) { w.Defer = 8 },
+		"nest":    func(w *Weights) { w.Nest = 16 },
+		"recover": func(w *Weights) { w.Recover = 8 },
+		"panic":   func(w *Weights) { w.Panic = 8 },
+		"extra":   func(w *Weights) { w.Extra = 8 },
+	}
+	for name, adjust := range favor {
+		w := defaultWeights
+		adjust(&w)
+		setWeights(t, w)
+		for _, lang := range []string{"", "go1.23"} {
+			setFlag(t, "lang", lang)
+			for seed := int64(1); seed <= 300; seed++ {
+				m := build(rand.New(rand.NewSource(seed)))
+				if _, err := program(m, "test"); err != nil {
+					t.Errorf("favoring %v, -lang %q, seed %v: %v", name, lang, seed, err)
+				}
+			}
+		}
+	}
+}
+
+// TestOpenCoded checks that OpenCoded reports the functions whose
+// defers the compiler open-coded, once for each shape.
+func TestOpenCoded(t *testing.T) {
+	const src = `package main
+
+func step(int) {}
+
+func main() {
+	func() {
+		defer step(1)
+		step(2)
+	}()
+	func() {
+		defer step(3)
+		step(4)
+	}()
+	func() {
+		for i := 0; i < 2; i++ {
+			defer step(i)
+		}
+	}()
+}
+`
+	file := filepath.Join(t.TempDir(), "test.go")
+	if err := ioutil.WriteFile(file, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	shapes, err := OpenCoded(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"func() { defer step(N) step(N) }"}
+	if !reflect.DeepEqual(shapes, want) {
+		t.Errorf("OpenCoded returned %q, want %q", shapes, want)
+	}
+}
+
+// TestStepDiff checks that stepDiff marks the first step a program
+// printed out of order.
+func TestStepDiff(t *testing.T) {
+	m := B().Step().Step().Step().Build()
+	var buf bytes.Buffer
+	stepDiff(&buf, m, []byte("step 1\nexpect 0\nstep 3\nstep 2\n"), 0)
+	want := "steps (expected | observed, from line 1 of 3; > marks differences):\n" +
+		"  step 1       | step 1\n" +
+		"> step 2       | step 3\n" +
+		"> step 3       | step 2\n"
+	if buf.String() != want {
+		t.Errorf("stepDiff wrote:\n%v\nwant:\n%v", buf.String(), want)
+	}
+
+	buf.Reset()
+	stepDiff(&buf, m, []byte("step 1\nstep 2\nstep 3\n"), 0)
+	if want := "steps: as expected (3 lines)\n"; buf.String() != want {
+		t.Errorf("stepDiff wrote %q, want %q", buf.String(), want)
+	}
+}
+
+// TestPlaybackExhausted checks that a decision log that runs out, so
+// that every later decision is 0, still produces a call tree.
+func TestPlaybackExhausted(t *testing.T) {
+	for _, log := range [][]int{nil, {0, 0, 0}, {5, 1, 7}} {
+		done := make(chan bool)
+		go func() {
+			build(&playback{log: log})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("build doesn't finish for decision log %v", log)
+		}
+	}
+}
+
+// TestMutate checks that mutants of decision logs produce well-formed
+// programs.
+func TestMutate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var corpus [][]int
+	for i := 0; i < 200; i++ {
+		log := mutate(r, corpus)
+		m := build(&playback{log: log})
+		if _, err := program(m, "test"); err != nil {
+			t.Fatalf("mutant %v: %v", log, err)
+		}
+		if i%10 == 0 {
+			corpus = append(corpus, log)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Event is a record in the -log file, which has one JSON object
+// per line. Which fields are set depends on Event.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"` // begin, start, generated, result, failure, or done
+	Iter  int       `json:"iter"`
+	Seed  int64     `json:"seed,omitempty"`
+
+	// begin
+	Toolchain string `json:"toolchain,omitempty"`
+
+	// generated
+	Stmts  int            `json:"stmts,omitempty"`
+	Defers int            `json:"defers,omitempty"`
+	Calls  map[string]int `json:"calls,omitempty"`
+	Depth  int            `json:"depth,omitempty"`
+
+	// result and done
+	Pass    bool    `json:"pass,omitempty"`
+	Elapsed float64 `json:"elapsed,omitempty"` // seconds
+	Ran     int     `json:"ran,omitempty"`
+
+	// failure
+	Error  string `json:"error,omitempty"`
+	Class  string `json:"class,omitempty"`
+	File   string `json:"file,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+var (
+	logMu  sync.Mutex
+	logEnc *json.Encoder // nil unless -log is set
+)
+
+// openLog opens the -log file, if any.
+func openLog() {
+	if *logFile == "" {
+		return
+	}
+	f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		fatal(err)
+	}
+	logEnc = json.NewEncoder(f)
+}
+
+// emit appends e to the -log file, if any, and adds it to the -report
+// session, if any.
+func emit(e *Event) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	e.Time = time.Now()
+	if session != nil {
+		session.add(e)
+	}
+	if logEnc == nil {
+		return
+	}
+	if err := logEnc.Encode(e); err != nil {
+		fatal(err)
+	}
+}
+
+// generated returns the generated event for the call tree m.
+func generated(i int, seed int64, m *Multi) *Event {
+	var s Stats
+	s.Add(m)
+	e := &Event{Event: "generated", Iter: i, Seed: seed, Stmts: s.Stmts, Defers: s.Defers, Calls: s.Calls}
+	for d := range s.Depth {
+		e.Depth = d
+	}
+	return e
+}
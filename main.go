@@ -0,0 +1,1018 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	seedFlag    = flag.Int64("seed", 0, "generate the program for iteration i with seed `s`+i (0 means a time-based seed)")
+	procs       = flag.Int("p", 1, "run `n` programs in parallel, each in its own worker directory")
+	iters       = flag.Int("n", 0, "stop after running `n` programs (0 means no limit)")
+	duration    = flag.Duration("duration", 0, "stop after running programs for `d` (0 means no limit)")
+	verbose     = flag.Bool("v", false, "print the call tree and expected trace of every program")
+	quiet       = flag.Bool("q", false, "print only failures and summaries, omitting progress and program output")
+	timeout     = flag.Duration("timeout", 30*time.Second, "give up on building and running a program after `d` (0 means no limit)")
+	goFlag      = flag.String("go", "go", "test the go `tool` at this path, or in this GOROOT")
+	gcflags     = flag.String("gcflags", "", "build programs with go build -gcflags `flags`, like all=-d=ssa/check/on")
+	ldflags     = flag.String("ldflags", "", "build programs with go build -ldflags `flags`")
+	workdir     = flag.String("workdir", "", "check programs in `dir`, instead of a temporary directory removed on exit")
+	logFile     = flag.String("log", "", "append a JSON object describing each step of the campaign to `file`, one per line")
+	reportFile  = flag.String("report", "", "at exit, summarize the campaign in `file`, as HTML if it ends in .html and Markdown otherwise")
+	crashDir    = flag.String("crashdir", "crashes", "save each failing program, its output, and how to reproduce it in a new directory in `dir`")
+	artifactCap = flag.Int("max-artifacts", 0, "save at most `n` failing programs in all, removing programs of the kinds of failure with the most saved to make room (0 means no limit)")
+	bucketCap   = flag.Int("bucket-cap", 3, "save at most the `n` smallest failing programs with the same class and signature (0 means none)")
+	rerunModes  = flag.Bool("rerun-modes", true, "rerun each saved failing program under alternate compilation modes, like -gcflags=all=-N -l")
+	autoMin     = flag.Bool("minimize", false, "minimize each failing program, saving the result in its -crashdir directory")
+	reduceLimit = flag.Duration("reduce-timeout", 10*time.Minute, "stop minimizing a program after `d`, keeping the smallest failing program so far (0 means no limit)")
+	onFailure   = flag.String("on-failure", "", "run `command` with the -crashdir directory of each new kind of failure as its last argument")
+	maxBuckets  = flag.Int("max-unique-failures", 0, "stop after `n` distinct kinds of failure, by class and signature (0 means no limit)")
+	failFast    = flag.Bool("fail-fast", false, "stop at the first failing program, instead of reporting all failures at exit")
+	printTree   = flag.Bool("print-tree-on-fail", true, "print the call tree of a failing program to stderr, at -fail-verbosity 2 or more")
+	failVerbose = flag.Int("fail-verbosity", 2, "report each failing program at `level` 0 (one line), 1 (and its output), 2 (and its call tree and a diff of its expected and observed steps), or 3 (and its source, and all of its output and diff)")
+	failLines   = flag.Int("fail-lines", 40, "below -fail-verbosity 3, report at most the last `n` lines of a failing program's output, and `n` lines of its step diff")
+	statsEvery  = flag.Duration("stats", 0, "print throughput, failures, and the mix of generated constructs every `interval` (0 means never)")
+	progress    = flag.Duration("progress", 10*time.Second, "print the iteration count at most once per `interval` (0 means every iteration)")
+	checkpoint  = flag.String("checkpoint", "", "record the seed, number of completed iterations, and generation flags in `file`")
+	resume      = flag.Bool("resume", false, "resume from the -checkpoint file, if it exists")
+	inline      = flag.Bool("inline", false, "allow the compiler to inline generated functions")
+	cmpInline   = flag.Bool("compare-inlined", false, "also run each program with inlining allowed, and require the same trace")
+	explain     = flag.Bool("explain", false, "annotate each generated statement with its simulated effect")
+	crossOracle = flag.Bool("cross-oracle", false, "require all oracles to agree on each call tree")
+	noHeapDefer = flag.Bool("assert-no-alloc-in-defer", false, "fail if the compiler heap-allocates a defer outside of a loop")
+	outdir      = flag.String("outdir", "", "archive every generated program in `dir`, named by iteration and seed")
+	keep        = flag.Int("keep", 0, "with -outdir, keep only the `n` most recent programs (0 means keep all)")
+	budget      = flag.String("budget", "100", "generate call trees of about `n` calls, or of a size sampled from min-max for each program")
+	weightsFile = flag.String("weights", "", "read the relative frequencies of generated constructs from JSON `file`")
+	pDefer      = flag.Float64("p-defer", -1, "defer calls with probability `p`, overriding -weights")
+	pNest       = flag.Float64("p-nest", -1, "make calls to nested function literals with probability `p`, overriding -weights")
+	pRecover    = flag.Float64("p-recover", -1, "make calls to recover with probability `p`, overriding -weights")
+	pPanic      = flag.Float64("p-panic", -1, "make calls to panic with probability `p`, overriding -weights")
+	maxDepth    = flag.Int("max-depth", 0, "limit the nesting of function literals to `n` levels (0 means no limit)")
+	osExit      = flag.Bool("os-exit", false, "insert a call of os.Exit(0) at a random point in each program, after which no deferred call may run")
+	crashGo     = flag.Bool("crash-goroutine", false, "start a goroutine at a random point in each program whose panic isn't recovered, and require the program to crash with it")
+	bulkDefers  = flag.Int("bulk-defers", 0, "also generate calls to functions, and loops, that each register about `n` defers, which may need a longer -timeout")
+	lang        = flag.String("lang", "", "Go language `version` of generated programs, like go1.23; without it, constructs that need go1.20 or later, like generics, panic(nil), deferred clear, per-iteration loop variables, and range-over-func, aren't generated")
+	cmpCompile  = flag.Bool("compare-against-binary-cache", false, "compile each program twice, bypassing the build cache, and require identical object files")
+	openTarget  = flag.Int("max-open-coded-functions", 0, "stop after validating `n` distinct functions whose defers the compiler open-coded")
+	spikeRate   = flag.Float64("spike-rate", 0, "warn when more than `n` programs per minute fail, over the last -spike-window (0 means never)")
+	spikeWindow = flag.Duration("spike-window", time.Minute, "measure the failure rate for -spike-rate over the last `d`")
+	spikePause  = flag.Duration("spike-pause", 0, "after warning of a spike in the failure rate, pause for `d` before continuing")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	cmd, args := "run", flag.Args()
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "run":
+		fuzz(args)
+	case "gen":
+		gen(args)
+	case "replay", "once":
+		replay(args)
+	case "minimize":
+		minimize(args)
+	case "stats":
+		stats(args)
+	case "bisect":
+		bisect(args)
+	case "cover":
+		cover(args)
+	case "report":
+		summarize(args)
+	default:
+		fmt.Fprintf(os.Stderr, "deferfuzz: unknown command %q\n", cmd)
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: deferfuzz [flags] [command] [args]
+
+Commands:
+	run                  fuzz until stopped or a program fails (the default)
+	gen -seed S          write the program for seed S without running it
+	replay S|file        regenerate and run the program for seed S, or in file
+	minimize file        shrink the failing program in file
+	stats                summarize the call trees the generator produces
+	bisect -versions L f find the first Go release in L to run file like the last
+	cover -compiler C    mutate programs toward new coverage of compiler C
+	report log           summarize the last campaign in a -log file
+
+Exit status:
+	0  no program failed
+	1  some program failed
+	2  deferfuzz couldn't run, or was interrupted
+
+Flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(exitError)
+}
+
+// Exit statuses, which let scripts tell failing programs apart from
+// problems with deferfuzz or its environment, like a missing toolchain.
+const (
+	exitFailed = 1 // a program failed
+	exitError  = 2 // deferfuzz itself failed
+)
+
+// fatal and fatalf are like log.Fatal and log.Fatalf, but exit with
+// status exitError.
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(exitError)
+}
+
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(exitError)
+}
+
+// fuzz implements "deferfuzz run", which generates and runs programs
+// until a limit is reached or one of them fails. Flags may also
+// follow the command.
+func fuzz(args []string) {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 0 {
+		usage()
+	}
+
+	if *bucketCap < 0 {
+		fatalf("bad -bucket-cap %v", *bucketCap)
+	}
+	if *failLines < 1 {
+		fatalf("bad -fail-lines %v", *failLines)
+	}
+	if *inline && *cmpInline {
+		fatal("-compare-inlined needs programs that aren't inlined, so it can't be combined with -inline")
+	}
+	if *resume && *checkpoint == "" {
+		fatal("-resume needs a -checkpoint file to resume from")
+	}
+
+	seed, start := *seedFlag, 0
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	// Resume first, since the checkpoint may restore -lang.
+	if *resume {
+		s, n, err := readCheckpoint(*checkpoint)
+		switch {
+		case err == nil:
+			seed, start = s, n
+		case os.IsNotExist(err):
+			fmt.Printf("no checkpoint in %v; starting from seed %v\n", *checkpoint, seed)
+		default:
+			fatal(err)
+		}
+	}
+
+	openLog()
+	if *reportFile != "" {
+		session = new(summary)
+	}
+	v, err := goVersion()
+	if err != nil {
+		fatalf("%v version: %v", *goFlag, err)
+	}
+	if !*quiet {
+		fmt.Println("toolchain:", v)
+		if l := goLang.FindString(v); *lang == "" && l != "" {
+			fmt.Printf("not generating constructs that need a newer Go version; set -lang %v to enable them\n", l)
+		}
+	}
+
+	emit(&Event{Event: "begin", Iter: start, Seed: seed, Toolchain: v})
+
+	work, cleanup := workDir()
+	defer cleanup()
+
+	if *cmpCompile {
+		if err := writeImportcfg(work); err != nil {
+			fatal(err)
+		}
+	}
+
+	dirs := []string{work}
+	if *procs > 1 {
+		dirs = nil
+		for w := 0; w < *procs; w++ {
+			dir := filepath.Join(work, fmt.Sprintf("worker%v", w))
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				fatal(err)
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if *outdir != "" {
+		if err := os.MkdirAll(*outdir, 0777); err != nil {
+			fatal(err)
+		}
+	}
+
+	begin := time.Now()
+	jobs := make(chan int)
+	stop := make(chan bool)
+	stopped := false
+	halt := func() {
+		if !stopped {
+			close(stop)
+			stopped = true
+		}
+	}
+	go func() {
+		defer close(jobs)
+		for i := start; *iters == 0 || i < start+*iters; i++ {
+			if *duration > 0 && time.Since(begin) >= *duration {
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	results := make(chan *result)
+	var wg sync.WaitGroup
+	for _, dir := range dirs {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			for i := range jobs {
+				results <- check(seed+int64(i), i, dir)
+			}
+		}(dir)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	ran := 0
+	next := start // all iterations before next have completed
+	done := make(map[int]bool)
+	openCoded := make(map[string]bool)
+	var archived []string
+	var failures triage
+	watch := watchdog{window: *spikeWindow}
+	var st Stats
+	var lastProgress, lastStats time.Time
+	for r := range results {
+		emit(&Event{Event: "result", Iter: r.i, Seed: r.seed, Pass: r.err == nil, Elapsed: r.elapsed.Seconds()})
+		ran++
+		if r.err != nil {
+			saved := failures.add(r)
+			emit(&Event{Event: "failure", Iter: r.i, Seed: r.seed, Error: r.err.Error(), Class: r.class, File: r.file, Output: string(r.out)})
+			if *failFast {
+				report(r)
+				cleanup()
+				os.Exit(exitFailed)
+			}
+			if saved {
+				fmt.Fprintf(os.Stderr, "FAIL (%v): seed %v: %v (%v)\n", r.class, r.seed, r.err, filepath.Dir(r.file))
+				if e := explanation(r.out); e != "" {
+					fmt.Fprintf(os.Stderr, "\t%v\n", e)
+				}
+			} else if !*quiet {
+				fmt.Fprintf(os.Stderr, "FAIL (%v): seed %v: %v (not saved)\n", r.class, r.seed, r.err)
+			}
+			if *maxBuckets > 0 && len(failures.order) >= *maxBuckets && !stopped {
+				fmt.Printf("stopping after %v distinct kinds of failure\n", len(failures.order))
+				halt()
+			}
+		}
+		if *spikeRate > 0 && watch.observe(time.Now(), r.err != nil, *spikeRate) {
+			fmt.Fprintf(os.Stderr, "\nWARNING: %v programs failed in the last %v, more than -spike-rate %v per minute;\nthe toolchain or environment may be broken, or a bug is being hit by most programs\n\n", len(watch.fails), watch.window, *spikeRate)
+			if *spikePause > 0 {
+				// Workers block sending their results meanwhile.
+				fmt.Fprintf(os.Stderr, "pausing for %v\n", *spikePause)
+				time.Sleep(*spikePause)
+			}
+		}
+		if r.archive != "" {
+			archived = append(archived, r.archive)
+			if *keep > 0 && len(archived) > *keep {
+				os.Remove(archived[0])
+				archived = archived[1:]
+			}
+		}
+		if *verbose {
+			fmt.Printf("%v (seed %v):\n", r.i, r.seed)
+			describe(os.Stdout, r.m)
+		} else if !*quiet && time.Since(lastProgress) >= *progress {
+			fmt.Printf("%v (seed %v)\n", r.i, r.seed)
+			lastProgress = time.Now()
+		}
+
+		st.Add(r.m)
+		if *statsEvery > 0 && time.Since(lastStats) >= *statsEvery {
+			if !lastStats.IsZero() {
+				elapsed := time.Since(begin)
+				fmt.Printf("after %v: %.1f programs/s, %v failures; ", elapsed.Round(time.Second), float64(ran)/elapsed.Seconds(), failures.n)
+				st.Print(os.Stdout)
+			}
+			lastStats = time.Now()
+		}
+
+		done[r.i] = true
+		for done[next] {
+			delete(done, next)
+			next++
+		}
+		if *checkpoint != "" {
+			if err := writeCheckpoint(*checkpoint, seed, next); err != nil {
+				fatal(err)
+			}
+		}
+
+		if *openTarget > 0 && len(openCoded) < *openTarget && r.err == nil {
+			for _, s := range r.openCoded {
+				openCoded[s] = true
+			}
+			if len(openCoded) >= *openTarget {
+				fmt.Printf("validated %v distinct functions with open-coded defers\n", len(openCoded))
+				halt()
+			}
+		}
+	}
+
+	emit(&Event{Event: "done", Seed: seed, Ran: ran, Elapsed: time.Since(begin).Seconds()})
+	fmt.Printf("ran %v programs in %v (seed %v)\n", ran, time.Since(begin).Round(time.Second), seed)
+	if session != nil {
+		if err := session.write(*reportFile); err != nil {
+			fatal(err)
+		}
+		fmt.Println("wrote", *reportFile)
+	}
+
+	if failures.n > 0 {
+		failures.report(ran)
+		cleanup()
+		os.Exit(exitFailed)
+	}
+}
+
+// A watchdog tracks the failure rate over a sliding window of time,
+// to notice when it suddenly spikes.
+type watchdog struct {
+	window time.Duration
+	fails  []time.Time // times of the failures within window
+	high   bool        // whether the rate is above the threshold
+}
+
+// observe records a result at now, which failed if failed, and reports
+// whether the failure rate just rose above rate failures per minute.
+// It reports each spike once, until the rate falls again.
+func (w *watchdog) observe(now time.Time, failed bool, rate float64) bool {
+	if failed {
+		w.fails = append(w.fails, now)
+	}
+	for len(w.fails) > 0 && now.Sub(w.fails[0]) > w.window {
+		w.fails = w.fails[1:]
+	}
+	high := float64(len(w.fails)) > rate*w.window.Minutes()
+	rose := high && !w.high
+	w.high = high
+	return rose
+}
+
+// workDir returns the directory for the programs being checked, and
+// a function that removes it if it's temporary. It's -workdir if set,
+// and otherwise a new temporary directory, which is also removed if
+// the campaign is interrupted. Failing programs are saved elsewhere,
+// by saveCrash.
+func workDir() (string, func()) {
+	if *workdir != "" {
+		if err := os.MkdirAll(*workdir, 0777); err != nil {
+			fatal(err)
+		}
+		return *workdir, func() {}
+	}
+	dir, err := os.MkdirTemp("", "deferfuzz")
+	if err != nil {
+		fatal(err)
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		os.RemoveAll(dir)
+		os.Exit(exitError)
+	}()
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// A result is the outcome of checking one program.
+type result struct {
+	i     int
+	seed  int64
+	m     *Multi
+	src   []byte // the program
+	file  string
+	out   []byte
+	err   error
+	class string   // the kind of failure, as returned by classify
+	modes []string // the results of rerun, if any
+
+	// With -compare-inlined, the inlined program and its output, if
+	// it failed or differed.
+	inlined    []byte
+	outInlined []byte
+
+	// With -max-open-coded-functions, the shapes of the functions
+	// with open-coded defers, if it passed.
+	openCoded []string
+
+	archive string        // copy of the program in -outdir, if any
+	elapsed time.Duration // time to generate and check the program
+}
+
+// check generates the program for seed in dir, and runs and checks it
+// as configured by flags.
+func check(seed int64, i int, dir string) *result {
+	emit(&Event{Event: "start", Iter: i, Seed: seed})
+	begin := time.Now()
+	r := check1(seed, i, dir)
+	r.elapsed = time.Since(begin)
+	return r
+}
+
+func check1(seed int64, i int, dir string) *result {
+	m, buf := generate(seed)
+	if logEnc != nil || session != nil {
+		emit(generated(i, seed, m))
+	}
+	if *inline {
+		buf = allowInlining(buf)
+	}
+	file := filepath.Join(dir, "test.go")
+	r := &result{i: i, seed: seed, m: m, file: file, src: buf}
+	// Failing to write the program is a problem with the environment,
+	// not the program.
+	if err := ioutil.WriteFile(file, buf, 0666); err != nil {
+		fatal(err)
+	}
+	if *outdir != "" {
+		r.archive = filepath.Join(*outdir, fmt.Sprintf("%06d-%v.go", i, seed))
+		if err := ioutil.WriteFile(r.archive, buf, 0666); err != nil {
+			fatal(err)
+		}
+	}
+	if *crossOracle {
+		if r.err = crossCheck(m); r.err != nil {
+			return r
+		}
+	}
+	r.out, r.err = run(file)
+	if r.err == nil {
+		r.err = checkExit(m, r.out)
+	}
+	if r.err == nil && *cmpInline {
+		var out []byte
+		if out, r.err = runInlined(file, buf, r.out); r.err != nil {
+			r.inlined, r.outInlined = allowInlining(buf), out
+			if !errors.Is(r.err, errInlineTrace) {
+				r.out = out
+			}
+		}
+	}
+	if r.err == nil && *noHeapDefer {
+		if bad, err := heapDefers(file); err != nil {
+			r.err = err
+		} else if len(bad) > 0 {
+			r.err = fmt.Errorf("heap-allocated defers outside of loops at %v", bad)
+		}
+	}
+	if r.err == nil && *cmpCompile {
+		r.err = compileTwice(file)
+	}
+	if r.err == nil && *openTarget > 0 {
+		r.openCoded, r.err = OpenCoded(file)
+	}
+	if r.err != nil {
+		r.class = classify(r.out, r.err)
+	}
+	return r
+}
+
+// errInlineTrace is the error for a program whose trace differs with
+// inlining allowed.
+var errInlineTrace = errors.New("trace differs with inlining")
+
+// inlinedFile returns the file in which runInlined writes the inlined
+// variant of the program in file.
+func inlinedFile(file string) string {
+	return strings.TrimSuffix(file, ".go") + "_inl.go"
+}
+
+// runInlined runs the program in buf, which ran with output out from
+// file, again with inlining allowed, and returns the output and an
+// error if it fails or its output differs.
+func runInlined(file string, buf, out []byte) ([]byte, error) {
+	inl := inlinedFile(file)
+	if err := ioutil.WriteFile(inl, allowInlining(buf), 0666); err != nil {
+		fatal(err)
+	}
+	out2, err := run(inl)
+	if err != nil {
+		return out2, fmt.Errorf("with inlining: %w", err)
+	}
+	if !bytes.Equal(out, out2) {
+		return out2, errInlineTrace
+	}
+	return out2, nil
+}
+
+// checkExit returns an error if the output out of the program for m,
+// which may call os.Exit, doesn't end where os.Exit was called.
+func checkExit(m *Multi, out []byte) error {
+	e := exited(m)
+	if e == nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if want := fmt.Sprint("exit ", e.N); lines[len(lines)-1] != want {
+		return fmt.Errorf("output continues after %q", want)
+	}
+	return nil
+}
+
+// report reports a failing program, in as much detail as
+// -fail-verbosity asks for.
+func report(r *result) {
+	fmt.Fprintf(os.Stderr, "FAIL (%v): seed %v: %v\n", r.class, r.seed, r.err)
+	if *failVerbose < 1 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "program: %v\n", r.file)
+	if r.inlined != nil {
+		fmt.Fprintf(os.Stderr, "inlined program: %v\n", inlinedFile(r.file))
+	}
+	if v, err := goVersion(); err == nil {
+		fmt.Fprintf(os.Stderr, "toolchain: %v\n", v)
+	}
+	if e := explanation(r.out); e != "" {
+		fmt.Fprintf(os.Stderr, "explanation: %v\n", e)
+	}
+	full := *failVerbose >= 3
+	out := r.out
+	if lines := bytes.SplitAfter(out, []byte("\n")); !full && len(lines) > *failLines {
+		out = bytes.Join(lines[len(lines)-*failLines:], nil)
+		fmt.Fprintf(os.Stderr, "output (last %v of %v lines; see %v):\n", *failLines, len(lines), filepath.Join(filepath.Dir(r.file), "output.txt"))
+	} else {
+		fmt.Fprintln(os.Stderr, "output:")
+	}
+	os.Stderr.Write(out)
+	if len(r.modes) > 0 {
+		fmt.Fprintln(os.Stderr, "alternate compilation modes:")
+		for _, m := range r.modes {
+			fmt.Fprintf(os.Stderr, "  %v\n", m)
+		}
+	}
+	if *failVerbose < 2 {
+		return
+	}
+	if *printTree {
+		fmt.Fprintln(os.Stderr, "call tree:")
+		DumpTree(os.Stderr, r.m)
+	}
+	stepDiff(os.Stderr, r.m, r.out, diffLimit())
+	if full {
+		fmt.Fprintln(os.Stderr, "source:")
+		os.Stderr.Write(r.src)
+	}
+}
+
+// diffLimit returns the most lines of a step diff to report, as set
+// by -fail-verbosity and -fail-lines, or 0 for no limit.
+func diffLimit() int {
+	if *failVerbose >= 3 {
+		return 0
+	}
+	return *failLines
+}
+
+// stepDiff writes the steps, exits, and crashes that the program for m
+// should print, and those it printed in out, side by side to w,
+// marking those that differ. Recovers aren't compared, since the
+// program checks them itself. Unless limit is 0, stepDiff writes at
+// most limit lines, starting just before the first difference.
+func stepDiff(w io.Writer, m *Multi, out []byte, limit int) {
+	traced := func(s string) bool {
+		f := strings.Fields(s)
+		return len(f) == 2 && (f[0] == "step" || f[0] == "exit" || f[0] == "crash")
+	}
+	var want, have []string
+	for _, e := range (Sim{}).Events(m) {
+		if traced(e) {
+			want = append(want, e)
+		}
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if traced(line) {
+			have = append(have, strings.TrimSpace(line))
+		}
+	}
+
+	n := len(want)
+	if len(have) > n {
+		n = len(have)
+	}
+	first := -1
+	for i := 0; i < n && first < 0; i++ {
+		if i >= len(want) || i >= len(have) || want[i] != have[i] {
+			first = i
+		}
+	}
+	if first < 0 {
+		fmt.Fprintf(w, "steps: as expected (%v lines)\n", n)
+		return
+	}
+
+	start, end := 0, n
+	if limit > 0 {
+		if first > 2 {
+			start = first - 2
+		}
+		if end > start+limit {
+			end = start + limit
+		}
+	}
+	fmt.Fprintf(w, "steps (expected | observed, from line %v of %v; > marks differences):\n", start+1, n)
+	for i := start; i < end; i++ {
+		var e, o string
+		if i < len(want) {
+			e = want[i]
+		}
+		if i < len(have) {
+			o = have[i]
+		}
+		mark := " "
+		if e != o {
+			mark = ">"
+		}
+		fmt.Fprintf(w, "%v %-12v | %v\n", mark, e, o)
+	}
+	if end < n {
+		fmt.Fprintf(w, "  ... %v more\n", n-end)
+	}
+}
+
+// replay implements "deferfuzz replay", which generates, saves, and
+// runs the single program for a given seed. Iteration i of a fuzzing
+// campaign corresponds to seed S+i, where S is the campaign's seed.
+//
+// Instead of a seed, replay accepts a program saved by deferfuzz, and
+// regenerates it using the command recorded in its header.
+//
+// With -decisions, replay instead regenerates a program from a log of
+// the generator's random decisions, saved with each failing program,
+// which still produces a similar program after the generator changes.
+//
+// "deferfuzz once -seed S" is the old spelling of "deferfuzz replay S".
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	seed := fs.Int64("seed", 0, "generate the program for `seed`")
+	decisions := fs.String("decisions", "", "generate the program from the decision log in `file`, instead of a seed")
+	out := fs.String("out", "test.go", "write the program to `file`")
+	fs.Parse(args)
+	if fs.NArg() > 1 || fs.NArg() == 1 && *decisions != "" {
+		fatalf("usage: deferfuzz replay [-out file] seed|file|-decisions file")
+	}
+	var saved []byte
+	if fs.NArg() == 1 {
+		if n, err := strconv.ParseInt(fs.Arg(0), 10, 64); err == nil {
+			*seed = n
+		} else {
+			*seed, *decisions, saved = readGenerated(fs.Arg(0))
+		}
+	}
+
+	var m *Multi
+	var buf []byte
+	if *decisions != "" {
+		m, buf = regenerate(*decisions)
+	} else {
+		m, buf = generate(*seed)
+	}
+	if *inline {
+		buf = allowInlining(buf)
+	}
+	if saved != nil && !bytes.HasSuffix(saved, buf) { // ignoring any reproducer header
+		fmt.Fprintf(os.Stderr, "warning: %v differs from the regenerated program; the generator may have changed\n", fs.Arg(0))
+	}
+	if *crossOracle {
+		if err := crossCheck(m); err != nil {
+			fatal(err)
+		}
+	}
+	if *verbose {
+		describe(os.Stdout, m)
+	}
+	if err := ioutil.WriteFile(*out, buf, 0666); err != nil {
+		fatal(err)
+	}
+	output, err := run(*out)
+	if !*quiet || err != nil {
+		os.Stdout.Write(output)
+	}
+	if err != nil && *failVerbose >= 2 {
+		if *printTree {
+			DumpTree(os.Stderr, m)
+		}
+		stepDiff(os.Stderr, m, output, diffLimit())
+	}
+	if err != nil {
+		fmt.Println("FAIL", *out, err)
+		os.Exit(exitFailed)
+	}
+	fmt.Println("PASS", *out)
+}
+
+// describe writes the call tree of m and the trace it should produce
+// to w.
+func describe(w io.Writer, m *Multi) {
+	fmt.Fprintln(w, "call tree:")
+	DumpTree(w, m)
+	fmt.Fprintln(w, "expected trace:")
+	for _, e := range (Sim{}).Events(m) {
+		fmt.Fprintf(w, "  %v\n", e)
+	}
+}
+
+// gen implements "deferfuzz gen", which writes the program for a
+// given seed and the trace it should produce, without running it.
+func gen(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	seed := fs.Int64("seed", 0, "generate the program for `seed`")
+	out := fs.String("o", "-", "write the program to `file` (- means stdout)")
+	trace := fs.String("trace", "", "write the expected steps and recovers, one per line, to `file` (- means stdout)")
+	decisions := fs.String("decisions", "", "write the generator's random decisions to `file`, for replay -decisions")
+	fs.Parse(args)
+	if *decisions != "" {
+		if err := writeDecisions(*decisions, *seed); err != nil {
+			fatal(err)
+		}
+	}
+
+	m, buf := generate(*seed)
+	if *inline {
+		buf = allowInlining(buf)
+	}
+	if err := writeOut(*out, buf); err != nil {
+		fatal(err)
+	}
+	if *trace != "" {
+		var tbuf bytes.Buffer
+		for _, e := range (Sim{}).Events(m) {
+			fmt.Fprintln(&tbuf, e)
+		}
+		if err := writeOut(*trace, tbuf.Bytes()); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// writeOut writes data to file, or to stdout if file is "-".
+func writeOut(file string, data []byte) error {
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0666)
+}
+
+var noinline = regexp.MustCompile(`(?m)^\s*type _ int\n`)
+
+// allowInlining removes the declarations that prevent the functions
+// in a generated program from being inlined.
+func allowInlining(src []byte) []byte {
+	return noinline.ReplaceAll(src, nil)
+}
+
+// goCommand returns a command running the go tool selected by -go.
+func goCommand(args ...string) *exec.Cmd {
+	return goCommandContext(context.Background(), args...)
+}
+
+func goCommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	tool := *goFlag
+	if fi, err := os.Stat(tool); err == nil && fi.IsDir() {
+		tool = filepath.Join(tool, "bin", "go")
+	}
+	return exec.CommandContext(ctx, tool, args...)
+}
+
+// goVersion returns the output of "go version" for the go tool
+// selected by -go.
+func goVersion() (string, error) {
+	out, err := goCommand("version").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// buildFlags returns the -gcflags and -ldflags to pass to go build
+// and go run.
+func buildFlags() []string {
+	var flags []string
+	if *gcflags != "" {
+		flags = append(flags, "-gcflags="+*gcflags)
+	}
+	if *ldflags != "" {
+		flags = append(flags, "-ldflags="+*ldflags)
+	}
+	return flags
+}
+
+// run runs the program in file, returning its combined output.
+// With -goexperiment, it runs the program under each setting in turn,
+// and requires them to produce the same output.
+func run(file string) ([]byte, error) {
+	if len(experiments) == 0 {
+		return run1(file, buildFlags(), nil)
+	}
+	var first []byte
+	for i, exp := range experiments {
+		out, err := run1(file, buildFlags(), []string{"GOEXPERIMENT=" + exp})
+		if err != nil {
+			return out, fmt.Errorf("GOEXPERIMENT=%v: %w", exp, err)
+		}
+		if i == 0 {
+			first = out
+		} else if !bytes.Equal(out, first) {
+			return out, fmt.Errorf("GOEXPERIMENT=%v: output differs from GOEXPERIMENT=%v", exp, experiments[0])
+		}
+	}
+	return first, nil
+}
+
+// goLang matches the language version in the output of "go version".
+var goLang = regexp.MustCompile(`go1\.\d+`)
+
+var crashLine = regexp.MustCompile(`(?m)^crash (-?\d+)\npanic: (-?\d+)\n`)
+
+// expectedCrash returns the output and error of a program that may
+// crash on purpose, with -crash-goroutine. If the program announced a
+// crash with panic N, and then crashed with it immediately, the output
+// is truncated after the panic, which is the end of the trace, and
+// the error is nil.
+func expectedCrash(out []byte, err error) ([]byte, error) {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() != 2 {
+		return out, err
+	}
+	m := crashLine.FindSubmatchIndex(out)
+	if m == nil || !bytes.Equal(out[m[2]:m[3]], out[m[4]:m[5]]) {
+		return out, err
+	}
+	return out[:m[1]], nil
+}
+
+// run1 builds the program in file with the build flags in flags, and
+// runs it once, with env added to the environment. It returns the
+// combined output of whichever fails, and gives up after -timeout.
+func run1(file string, flags, env []string) ([]byte, error) {
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	exe, err := filepath.Abs(strings.TrimSuffix(file, ".go"))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(exe)
+	args := append([]string{"build"}, flags...)
+	build := goCommandContext(ctx, append(args, "-o", exe, file)...)
+	prog := exec.CommandContext(ctx, exe)
+	if env != nil {
+		build.Env = append(os.Environ(), env...)
+		prog.Env = build.Env
+	}
+
+	out, err := build.CombinedOutput()
+	if err == nil {
+		out, err = expectedCrash(prog.CombinedOutput())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%w after %v", errTimeout, *timeout)
+	}
+	return out, err
+}
+
+// A stringList is a flag that may be repeated, and accumulates its
+// values.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, " ") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// experiments lists the -goexperiment settings.
+var experiments stringList
+
+func init() {
+	flag.Var(&experiments, "goexperiment", "also run each program with GOEXPERIMENT=`setting`; may be repeated")
+}
+
+// readCheckpoint returns the seed and number of completed iterations
+// recorded in file by writeCheckpoint, and restores the generation
+// flags recorded with them.
+func readCheckpoint(file string) (seed int64, n int, err error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	lines := strings.SplitN(string(buf), "\n", 2)
+	if _, err := fmt.Sscan(lines[0], &seed, &n); err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(lines) > 1 {
+		if err := restoreFlags(strings.Fields(lines[1])); err != nil {
+			return 0, 0, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return seed, n, nil
+}
+
+// restoreFlags sets the generation flags to those in args, as written
+// by genArgs, and the rest of them to their defaults. It fails, rather
+// than generating different programs, if a flag set on the command
+// line has a different value.
+func restoreFlags(args []string) error {
+	want := make(map[string]string)
+	for _, name := range genFlags {
+		want[name] = flag.Lookup(name).DefValue
+	}
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		if _, ok := want[name]; !ok {
+			return fmt.Errorf("not a generation flag: %v", args[i])
+		}
+		switch {
+		case hasValue:
+		case isBoolFlag(flag.Lookup(name)):
+			value = "true"
+		case i+1 < len(args):
+			i++
+			value = args[i]
+		default:
+			return fmt.Errorf("flag needs an argument: %v", args[i])
+		}
+		want[name] = value
+	}
+
+	var conflicts []string
+	flag.Visit(func(f *flag.Flag) {
+		if value, ok := want[f.Name]; ok && f.Value.String() != value {
+			conflicts = append(conflicts, fmt.Sprintf("-%v %v (checkpoint has %q)", f.Name, f.Value, value))
+		}
+	})
+	if conflicts != nil {
+		return fmt.Errorf("flags conflict with checkpoint: %v", strings.Join(conflicts, ", "))
+	}
+	for _, name := range genFlags {
+		if err := flag.Set(name, want[name]); err != nil {
+			return fmt.Errorf("-%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// writeCheckpoint records seed, the number of completed iterations n,
+// and the generation flags in file, so that the campaign can be
+// resumed with the same programs.
+func writeCheckpoint(file string, seed int64, n int) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%v %v\n%v\n", seed, n, strings.TrimSpace(genArgs()))), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var generatedBy = regexp.MustCompile(`(?m)^// Generated by "deferfuzz(.*) (?:once -seed|replay) (?:(-?\d+)|-decisions (.+))"\.$`)
+
+// readGenerated reads a program generated by deferfuzz from file,
+// sets the generation flags recorded in its header, and returns its
+// seed, or the decision log it was generated from, if any, and its
+// contents.
+func readGenerated(file string) (seed int64, decisions string, src []byte) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		fatal(err)
+	}
+	match := generatedBy.FindSubmatch(src)
+	if match == nil {
+		fatalf("%v: not generated by deferfuzz", file)
+	}
+	if err := flag.CommandLine.Parse(strings.Fields(string(match[1]))); err != nil {
+		fatal(err)
+	}
+	if match[3] != nil {
+		return 0, string(match[3]), src
+	}
+	seed, _ = strconv.ParseInt(string(match[2]), 10, 64)
+	return seed, "", src
+}
+
+// minimize implements "deferfuzz minimize", which regenerates the
+// call tree of a failing program from the command in its header, and
+// simplifies it for as long as the program still fails the same way.
+func minimize(args []string) {
+	fs := flag.NewFlagSet("minimize", flag.ExitOnError)
+	out := fs.String("out", "min.go", "write the minimized program to `file`")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal("usage: deferfuzz minimize [-out file] file")
+	}
+
+	seed, decisions, _ := readGenerated(fs.Arg(0))
+	var m *Multi
+	var buf []byte
+	var from string
+	if decisions != "" {
+		m, buf = regenerate(decisions)
+		from = decisionsCommand(decisions)
+	} else {
+		m, buf = generate(seed)
+		from = command(seed)
+	}
+	sig, ok := failure(*out, buf)
+	fails := failsWith(*out, sig)
+	if *cmpInline {
+		sig, ok = failureInlined(*out, buf)
+		fails = failsInlined(*out, sig)
+	}
+	if !ok {
+		fatalf("program generated by %q does not fail", from)
+	}
+	fmt.Printf("minimizing failure: %v\n", sig)
+	shrink(m, from, fails)
+	fmt.Println("wrote", *out)
+}
+
+// shrink simplifies m, the call tree generated by the command from,
+// for as long as fails reports that its program still fails the same
+// way. It tries removing statements, flattening nested function
+// literals into their callers, and turning panics and recovers into
+// steps, and leaves the program for the simplest failing tree where
+// fails wrote it. After -reduce-timeout, it stops trying, leaving the
+// simplest failing tree so far.
+func shrink(m *Multi, from string, fails func(buf []byte) bool) {
+	comment := fmt.Sprintf("Minimized from the program generated by %q.", from)
+	var deadline time.Time
+	if *reduceLimit > 0 {
+		deadline = time.Now().Add(*reduceLimit)
+	}
+	expired := func() bool {
+		return !deadline.IsZero() && time.Now().After(deadline)
+	}
+
+	// try reports whether m, as modified, still fails with sig.
+	try := func() bool {
+		if expired() {
+			return false
+		}
+		buf, err := program(m, comment)
+		if err != nil {
+			return false
+		}
+		return fails(buf)
+	}
+
+	for changed := true; changed && !expired(); {
+		changed = false
+		walk(m, func(m *Multi) {
+			for i := len(m.Body) - 1; i >= 0; i-- {
+				body := m.Body
+				m.Body = append(append([]*Stmt(nil), body[:i]...), body[i+1:]...)
+				if try() {
+					changed = true
+					continue
+				}
+				m.Body = body
+
+				switch c := body[i].Call.(type) {
+				case *Multi:
+					m.Body = append(append(append([]*Stmt(nil), body[:i]...), c.Body...), body[i+1:]...)
+					if try() {
+						changed = true
+						continue
+					}
+					m.Body = body
+				case *Unit:
+					if c.Kind == Normal {
+						break
+					}
+					kind, box := c.Kind, c.Box
+					c.Kind, c.Box = Normal, ""
+					if try() {
+						changed = true
+						continue
+					}
+					c.Kind, c.Box = kind, box
+				}
+			}
+		})
+	}
+
+	if expired() {
+		fmt.Fprintf(os.Stderr, "%v: stopped minimizing after -reduce-timeout %v\n", from, *reduceLimit)
+	}
+
+	// Leave the simplest failing program in place.
+	buf, err := program(m, comment)
+	if err != nil {
+		fatal(err)
+	}
+	fails(buf)
+}
+
+// walk calls visit for m and every Multi nested within it,
+// outermost first.
+func walk(m *Multi, visit func(*Multi)) {
+	visit(m)
+	for _, stmt := range m.Body {
+		for _, c := range children(stmt.Call) {
+			walk(c, visit)
+		}
+	}
+}
+
+// failure writes the program in buf to file and runs it. If it fails,
+// failure returns a signature of the failure and true.
+func failure(file string, buf []byte) (string, bool) {
+	if *inline {
+		buf = allowInlining(buf)
+	}
+	if err := ioutil.WriteFile(file, buf, 0666); err != nil {
+		fatal(err)
+	}
+	out, err := run(file)
+	if err == nil {
+		return "", false
+	}
+	return signature(out), true
+}
+
+// failsWith returns a test of whether a program, written to file,
+// fails with signature sig.
+func failsWith(file, sig string) func([]byte) bool {
+	return func(buf []byte) bool {
+		s, ok := failure(file, buf)
+		return ok && s == sig
+	}
+}
+
+// failureInlined is like failure, but for a program that passes, and
+// then fails or produces different output with inlining allowed, as
+// checked by -compare-inlined. The signature is of the inlined
+// program's failure, if any.
+func failureInlined(file string, buf []byte) (string, bool) {
+	if err := ioutil.WriteFile(file, buf, 0666); err != nil {
+		fatal(err)
+	}
+	out, err := run(file)
+	if err != nil {
+		return "", false
+	}
+	out2, err := runInlined(file, buf, out)
+	if err == nil {
+		return "", false
+	}
+	return inlinedSignature(out2, err), true
+}
+
+// inlinedSignature returns the signature of the failure with error err
+// of a program with inlining allowed, with output out, which may not
+// have failed but only differed.
+func inlinedSignature(out []byte, err error) string {
+	if errors.Is(err, errInlineTrace) {
+		return err.Error()
+	}
+	return signature(out)
+}
+
+// failsInlined returns a test of whether a program, written to file,
+// fails with inlining allowed with signature sig, like failureInlined.
+func failsInlined(file, sig string) func([]byte) bool {
+	return func(buf []byte) bool {
+		s, ok := failureInlined(file, buf)
+		return ok && s == sig
+	}
+}
+
+var (
+	hexNums = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	dirs    = regexp.MustCompile(`(?:[\w.-]*/)+`)
+	digits  = regexp.MustCompile(`[0-9]+`)
+)
+
+// signature returns the line of output that explains a failure,
+// normalized so that failures with the same cause have the same
+// signature: addresses, directories, and other numbers, like goroutine
+// IDs and steps, which vary as a program is minimized, are elided.
+func signature(out []byte) string {
+	return normalize(explanation(out))
+}
+
+// explanation returns the first line of output that describes a
+// failure, skipping build headers and the trace of steps.
+func explanation(out []byte) string {
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		f := bytes.Fields(line)
+		if len(f) == 0 || string(f[0]) == "#" {
+			continue
+		}
+		switch string(f[0]) {
+		case "step", "exit", "crash", "expect", "expectret", "expecterr", "expectassert", "expectnil", "expectpanicnil", "expectfault":
+			if len(f) <= 2 {
+				continue // trace
+			}
+		}
+		return string(line)
+	}
+	return ""
+}
+
+func normalize(s string) string {
+	s = hexNums.ReplaceAllString(s, "0xX")
+	s = dirs.ReplaceAllString(s, "")
+	return digits.ReplaceAllString(s, "N")
+}
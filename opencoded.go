@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// maxOpenDefers is the most defer statements a function can have and
+// still use open-coded defers.
+const maxOpenDefers = 8
+
+var (
+	openDefer = regexp.MustCompile(`(?m):(\d+):(\d+): open-coded defer$`)
+	number    = regexp.MustCompile(`\d+`)
+)
+
+// OpenCoded compiles the program in file and returns the shapes of the
+// functions whose defers the compiler open-coded. A function's shape
+// is its source with numbers, layout, and the bodies of nested
+// function literals elided, so that functions alike but for the steps
+// they record are reported once.
+func OpenCoded(file string) ([]string, error) {
+	out, err := compileDefers(file)
+	if err != nil {
+		return nil, err
+	}
+	open := make(map[string]bool)
+	for _, m := range openDefer.FindAllStringSubmatch(out, -1) {
+		open[m[1]+":"+m[2]] = true
+	}
+
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var shapes []string
+	var stack []ast.Node
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return false
+		}
+		stack = append(stack, n)
+		d, ok := n.(*ast.DeferStmt)
+		if !ok {
+			return true
+		}
+		pos := fset.Position(d.Pos())
+		if !open[fmt.Sprintf("%v:%v", pos.Line, pos.Column)] {
+			return true
+		}
+		for i := len(stack) - 1; i >= 0; i-- {
+			switch fn := stack[i].(type) {
+			case *ast.FuncDecl, *ast.FuncLit:
+				if s := funcShape(fset, src, fn); !seen[s] {
+					seen[s] = true
+					shapes = append(shapes, s)
+				}
+				return true
+			}
+		}
+		return true
+	})
+	return shapes, nil
+}
+
+// funcShape returns the shape of the function fn, parsed from src, as
+// described by OpenCoded.
+func funcShape(fset *token.FileSet, src []byte, fn ast.Node) string {
+	offset := func(p token.Pos) int { return fset.Position(p).Offset }
+	var sb strings.Builder
+	start := offset(fn.Pos())
+	ast.Inspect(fn, func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok || n == fn {
+			return true
+		}
+		sb.Write(src[start:offset(lit.Body.Pos())])
+		sb.WriteString("{...}")
+		start = offset(lit.Body.End())
+		return false
+	})
+	sb.Write(src[start:offset(fn.End())])
+	return number.ReplaceAllString(strings.Join(strings.Fields(sb.String()), " "), "N")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// An Oracle predicts the behavior of a call tree.
+type Oracle interface {
+	// Events returns the sequence of steps and recovers that
+	// running m should produce, like "step 3" or "recover 2".
+	// Recovers that return nil are reported as "recover 0".
+	Events(m *Multi) []string
+}
+
+// Sim is the Oracle implemented by Run, which also numbers the
+// steps and panics in the call tree for Write.
+type Sim struct{}
+
+func (Sim) Events(m *Multi) []string {
+	simMu.Lock()
+	defer simMu.Unlock()
+	steps, panics, events = 0, 0, nil
+	panicBoxes = make(map[int]string)
+	simulate(m)
+	return events
+}
+
+// oracles lists the oracles compared by -cross-oracle.
+// Independent implementations should be added here.
+var oracles = map[string]Oracle{
+	"sim": Sim{},
+}
+
+// crossCheck returns an error describing the first disagreement
+// between the registered oracles about m, if any.
+func crossCheck(m *Multi) error {
+	var names []string
+	for name := range oracles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var want []string
+	for i, name := range names {
+		have := oracles[name].Events(m)
+		if i == 0 {
+			want = have
+			continue
+		}
+		for j := 0; j < len(have) || j < len(want); j++ {
+			if j >= len(have) || j >= len(want) || have[j] != want[j] {
+				return fmt.Errorf("oracles %v and %v disagree at event %v", names[0], name, j)
+			}
+		}
+	}
+
+	// Leave m numbered by Sim, for Write.
+	Sim{}.Events(m)
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// A summary collects the events of a campaign for its report.
+type summary struct {
+	Toolchain  string
+	Seed       int64
+	Begin, End time.Time
+	Ran        int
+	Failed     int
+	Stats      Stats
+	Buckets    []*failureBucket // in order of first failure
+	Throughput []interval
+
+	buckets map[string]*failureBucket
+	minutes map[int]*interval // results by minute since Begin
+}
+
+// A failureBucket is a group of failures with the same signature, as
+// computed by crashSignature.
+type failureBucket struct {
+	Sig     string
+	Class   string
+	N       int
+	Seed    int64  // the seed of the representative program
+	File    string // the representative program, minimized if possible
+	Program string
+
+	seeds []int64
+	files []string // saved programs, which may since have been removed
+}
+
+// An interval counts the results in a period of the campaign.
+type interval struct {
+	Minute   int // since the beginning of the campaign
+	Programs int
+	Failures int
+}
+
+// session collects the events of this campaign for -report, if set.
+var session *summary
+
+// add adds the event e to s. A begin event starts a new campaign.
+func (s *summary) add(e *Event) {
+	switch e.Event {
+	case "begin":
+		*s = summary{Toolchain: e.Toolchain, Seed: e.Seed, Begin: e.Time}
+	case "generated":
+		s.Stats.addEvent(e)
+	case "result":
+		s.Ran++
+		min := int(e.Time.Sub(s.Begin) / time.Minute)
+		if s.minutes == nil {
+			s.minutes = make(map[int]*interval)
+		}
+		iv := s.minutes[min]
+		if iv == nil {
+			iv = &interval{Minute: min}
+			s.minutes[min] = iv
+		}
+		iv.Programs++
+		if !e.Pass {
+			iv.Failures++
+		}
+	case "failure":
+		s.Failed++
+		r := &result{seed: e.Seed, out: []byte(e.Output), err: errors.New(e.Error), class: e.Class}
+		sig := crashSignature(r)
+		b := s.buckets[sig]
+		if b == nil {
+			if s.buckets == nil {
+				s.buckets = make(map[string]*failureBucket)
+			}
+			b = &failureBucket{Sig: sig, Class: e.Class, Seed: e.Seed}
+			s.buckets[sig] = b
+			s.Buckets = append(s.Buckets, b)
+		}
+		b.N++
+		b.seeds = append(b.seeds, e.Seed)
+		b.files = append(b.files, e.File)
+	}
+	s.End = e.Time
+}
+
+// addEvent adds the call tree described by the generated event e to s.
+func (s *Stats) addEvent(e *Event) {
+	if s.Calls == nil {
+		s.Calls = make(map[string]int)
+		s.Depth = make(map[int]int)
+	}
+	s.Programs++
+	s.Stmts += e.Stmts
+	s.Defers += e.Defers
+	for kind, n := range e.Calls {
+		s.Calls[kind] += n
+	}
+	s.Depth[e.Depth]++
+}
+
+// finish picks the representative program of each bucket, the smallest
+// one still saved, preferring its minimized version, and groups the
+// results into at most about 20 intervals.
+func (s *summary) finish() {
+	for _, b := range s.Buckets {
+		minimized := false
+		for i, file := range b.files {
+			min := filepath.Join(filepath.Dir(file), "min.go")
+			if src, err := ioutil.ReadFile(min); err == nil {
+				if !minimized || len(src) < len(b.Program) {
+					b.Seed, b.File, b.Program, minimized = b.seeds[i], min, string(src), true
+				}
+				continue
+			}
+			if minimized {
+				continue
+			}
+			if src, err := ioutil.ReadFile(file); err == nil && (b.File == "" || len(src) < len(b.Program)) {
+				b.Seed, b.File, b.Program = b.seeds[i], file, string(src)
+			}
+		}
+	}
+
+	last := int(s.End.Sub(s.Begin) / time.Minute)
+	width := last/20 + 1
+	s.Throughput = nil
+	for min := 0; min <= last; min++ {
+		if min%width == 0 {
+			s.Throughput = append(s.Throughput, interval{Minute: min})
+		}
+		if iv := s.minutes[min]; iv != nil {
+			t := &s.Throughput[len(s.Throughput)-1]
+			t.Programs += iv.Programs
+			t.Failures += iv.Failures
+		}
+	}
+}
+
+// Elapsed returns the duration of the campaign so far.
+func (s *summary) Elapsed() time.Duration {
+	return s.End.Sub(s.Begin).Round(time.Second)
+}
+
+// Rate returns the campaign's throughput in programs per second.
+func (s *summary) Rate() float64 {
+	if d := s.End.Sub(s.Begin).Seconds(); d > 0 {
+		return float64(s.Ran) / d
+	}
+	return 0
+}
+
+// write writes the report for s to file, as HTML if its name ends in
+// .html and as Markdown otherwise.
+func (s *summary) write(file string) error {
+	s.finish()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	var t interface {
+		Execute(io.Writer, interface{}) error
+	}
+	if strings.HasSuffix(file, ".html") {
+		t = htmltemplate.Must(htmltemplate.New("report").Parse(htmlReport))
+	} else {
+		t = template.Must(template.New("report").Parse(markdownReport))
+	}
+	if err := t.Execute(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// summarize implements "deferfuzz report", which writes the report for
+// the last campaign in a -log file, which may still be running.
+func summarize(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	out := fs.String("o", "report.md", "write the report to `file`, as HTML if it ends in .html")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal("usage: deferfuzz report [-o file] log")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+	var s summary
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<30)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			fatalf("%v: %v", fs.Arg(0), err)
+		}
+		s.add(&e)
+	}
+	if err := sc.Err(); err != nil {
+		fatal(err)
+	}
+	if err := s.write(*out); err != nil {
+		fatal(err)
+	}
+	fmt.Println("wrote", *out)
+}
+
+const markdownReport = `# deferfuzz report
+
+- toolchain: {{.Toolchain}}
+- seed: {{.Seed}}
+- ran {{.Ran}} programs in {{.Elapsed}} ({{printf "%.1f" .Rate}} programs/s), starting {{.Begin.Format "2006-01-02 15:04:05"}}
+- {{.Failed}} failed, in {{len .Buckets}} distinct ways
+
+## Generated constructs
+
+{{.Stats.Stmts}} statements, {{.Stats.Defers}} deferred.
+
+| construct | statements |
+|---|---:|
+{{range $kind, $n := .Stats.Calls}}| {{$kind}} | {{$n}} |
+{{end}}
+| max depth | programs |
+|---:|---:|
+{{range $d, $n := .Stats.Depth}}| {{$d}} | {{$n}} |
+{{end}}
+## Failures
+{{range $b := .Buckets}}
+### {{$b.Sig}}
+
+{{$b.N}} failures, like the program for seed {{$b.Seed}}.
+{{if $b.File}}
+From {{$b.File}}:
+
+` + "```go" + `
+{{$b.Program}}` + "```" + `
+{{end}}{{else}}
+None.
+{{end}}
+## Throughput
+
+| minute | programs | failures |
+|---:|---:|---:|
+{{range .Throughput}}| {{.Minute}} | {{.Programs}} | {{.Failures}} |
+{{end}}`
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>deferfuzz report</title></head>
+<body>
+<h1>deferfuzz report</h1>
+<ul>
+<li>toolchain: {{.Toolchain}}</li>
+<li>seed: {{.Seed}}</li>
+<li>ran {{.Ran}} programs in {{.Elapsed}} ({{printf "%.1f" .Rate}} programs/s), starting {{.Begin.Format "2006-01-02 15:04:05"}}</li>
+<li>{{.Failed}} failed, in {{len .Buckets}} distinct ways</li>
+</ul>
+
+<h2>Generated constructs</h2>
+<p>{{.Stats.Stmts}} statements, {{.Stats.Defers}} deferred.</p>
+<table>
+<tr><th>construct</th><th>statements</th></tr>
+{{range $kind, $n := .Stats.Calls}}<tr><td>{{$kind}}</td><td>{{$n}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>max depth</th><th>programs</th></tr>
+{{range $d, $n := .Stats.Depth}}<tr><td>{{$d}}</td><td>{{$n}}</td></tr>
+{{end}}</table>
+
+<h2>Failures</h2>
+{{range .Buckets}}
+<h3>{{.Sig}}</h3>
+<p>{{.N}} failures, like the program for seed {{.Seed}}.</p>
+{{if .File}}<p>From {{.File}}:</p>
+<pre>{{.Program}}</pre>
+{{end}}{{else}}<p>None.</p>
+{{end}}
+<h2>Throughput</h2>
+<table>
+<tr><th>minute</th><th>programs</th><th>failures</th></tr>
+{{range .Throughput}}<tr><td>{{.Minute}}</td><td>{{.Programs}}</td><td>{{.Failures}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
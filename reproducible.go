@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// importcfg is the import configuration written by writeImportcfg.
+var importcfg string
+
+// writeImportcfg writes an import configuration for compiling
+// generated programs directly with "go tool compile" to dir.
+func writeImportcfg(dir string) error {
+	out, err := goCommand("list", "-export", "-f", "{{if .Export}}packagefile {{.ImportPath}}={{.Export}}{{end}}", "-deps", "log", "os", "runtime", "strings", "sync").Output()
+	if err != nil {
+		return fmt.Errorf("go list: %v", err)
+	}
+	importcfg = filepath.Join(dir, "importcfg")
+	return ioutil.WriteFile(importcfg, out, 0666)
+}
+
+// compileTwice compiles the program in file twice, bypassing the build
+// cache, and returns an error if the object files differ.
+func compileTwice(file string) error {
+	var objs [2][]byte
+	for i := range objs {
+		obj := fmt.Sprintf("%v.%v.o", file, i)
+		if out, err := goCommand("tool", "compile", "-p", "main", "-importcfg", importcfg, "-o", obj, file).CombinedOutput(); err != nil {
+			return fmt.Errorf("compile: %v\n%s", err, out)
+		}
+		var err error
+		if objs[i], err = ioutil.ReadFile(obj); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(objs[0], objs[1]) {
+		return fmt.Errorf("compiling %v twice produced different object files", file)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Stats summarizes the shapes of generated call trees.
+type Stats struct {
+	Programs int
+	Stmts    int
+	Defers   int
+	Calls    map[string]int // statements by kind of call
+	Depth    map[int]int    // programs by maximum nesting depth
+}
+
+// Add adds the call tree m to s.
+func (s *Stats) Add(m *Multi) {
+	if s.Calls == nil {
+		s.Calls = make(map[string]int)
+		s.Depth = make(map[int]int)
+	}
+	s.Programs++
+	s.Depth[s.add(m, 0)]++
+}
+
+// add adds the statements in m, at nesting depth depth, and returns
+// the maximum depth within m.
+func (s *Stats) add(m *Multi, depth int) int {
+	max := depth
+	for _, stmt := range m.Body {
+		s.Stmts++
+		if stmt.Defer {
+			s.Defers++
+		}
+		kind := strings.TrimPrefix(fmt.Sprintf("%T", stmt.Call), "*main.")
+		if kind == "Multi" {
+			kind = "func"
+		}
+		if u, ok := stmt.Call.(*Unit); ok {
+			kind = [...]string{Normal: "step", Recover: "recover", Panic: "panic"}[u.Kind]
+		}
+		s.Calls[kind]++
+		for _, c := range children(stmt.Call) {
+			if d := s.add(c, depth+1); d > max {
+				max = d
+			}
+		}
+	}
+	return max
+}
+
+// Print writes a summary of s to w.
+func (s *Stats) Print(w io.Writer) {
+	fmt.Fprintf(w, "%v programs, %v statements, %v deferred\n", s.Programs, s.Stmts, s.Defers)
+
+	var kinds []string
+	for kind := range s.Calls {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-12v %v\n", kind, s.Calls[kind])
+	}
+
+	var depths []int
+	for d := range s.Depth {
+		depths = append(depths, d)
+	}
+	sort.Ints(depths)
+	fmt.Fprintln(w, "max depth:")
+	for _, d := range depths {
+		fmt.Fprintf(w, "  %-12v %v\n", d, s.Depth[d])
+	}
+}
+
+// stats implements "deferfuzz stats", which summarizes the call trees
+// generated for a range of seeds without running them.
+func stats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	seed := fs.Int64("seed", 1, "start with the program for `seed`")
+	n := fs.Int("n", 1000, "summarize `n` programs")
+	fs.Parse(args)
+
+	var s Stats
+	for i := 0; i < *n; i++ {
+		m, _ := generate(*seed + int64(i))
+		s.Add(m)
+	}
+	s.Print(os.Stdout)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// Weights are the relative frequencies of the choices made by Fill.
+type Weights struct {
+	// Whether to defer a call or make it directly.
+	Defer int `json:"defer"`
+	Call  int `json:"call"`
+
+	// What to call: a nested function literal, a step, a recover
+	// (which is a step if deferred), a panic, or one of the less
+	// common patterns chosen by extra.
+	Nest    int `json:"nest"`
+	Step    int `json:"step"`
+	Recover int `json:"recover"`
+	Panic   int `json:"panic"`
+	Extra   int `json:"extra"`
+}
+
+var defaultWeights = Weights{
+	Defer: 1, Call: 1,
+	Nest: 4, Step: 2, Recover: 3, Panic: 1, Extra: 1,
+}
+
+var (
+	weightsOnce sync.Once
+	weightsVal  Weights
+)
+
+// weights returns the Weights read from the -weights file, which is
+// a JSON object with a subset of the Weights fields, using
+// defaultWeights for the rest, and then adjusted by the -p-* flags.
+func weights() Weights {
+	weightsOnce.Do(func() {
+		weightsVal = defaultWeights
+		if *weightsFile != "" {
+			readWeights(*weightsFile, &weightsVal)
+		}
+
+		w := &weightsVal
+		if *pDefer >= 0 {
+			if *pDefer > 1 {
+				fatalf("bad -p-defer %v", *pDefer)
+			}
+			w.Defer = int(*pDefer * scale)
+			w.Call = scale - w.Defer
+		}
+		setProbs(map[*int]float64{
+			&w.Nest:    *pNest,
+			&w.Recover: *pRecover,
+			&w.Panic:   *pPanic,
+		}, &w.Step, &w.Extra)
+
+		if err := w.check(); err != nil {
+			fatal(err)
+		}
+	})
+	return weightsVal
+}
+
+func readWeights(file string, w *Weights) {
+	f, err := os.Open(file)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(w); err != nil {
+		fatalf("%v: %v", file, err)
+	}
+	if err := w.check(); err != nil {
+		fatalf("%v: %v", file, err)
+	}
+}
+
+// check returns an error naming a weight in w that's negative, or the
+// weights of a choice that are all zero, which pick can't choose from.
+func (w *Weights) check() error {
+	v := reflect.ValueOf(w).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if n := v.Field(i).Int(); n < 0 {
+			return fmt.Errorf("negative weight %v for %q", n, v.Type().Field(i).Tag.Get("json"))
+		}
+	}
+	if w.Defer+w.Call == 0 {
+		return errors.New(`weights "defer" and "call" are all zero`)
+	}
+	if w.Nest+w.Step+w.Recover+w.Panic+w.Extra == 0 {
+		return errors.New(`weights "nest", "step", "recover", "panic", and "extra" are all zero`)
+	}
+	return nil
+}
+
+// scale is the total weight of a choice whose probabilities are set
+// by flags.
+const scale = 1000
+
+// setProbs adjusts the weights of a choice so that each weight in
+// probs that is set (non-negative) is chosen with that probability,
+// and the remaining weights, including others, share what's left in
+// proportion to their current values.
+func setProbs(probs map[*int]float64, others ...*int) {
+	var fixed float64
+	set := false
+	for w, p := range probs {
+		if p < 0 {
+			others = append(others, w)
+			continue
+		}
+		if p > 1 {
+			fatalf("bad probability %v", p)
+		}
+		fixed += p
+		set = true
+	}
+	if !set {
+		return
+	}
+	if fixed > 1 {
+		fatalf("probabilities sum to %v", fixed)
+	}
+
+	rest := 0
+	for _, w := range others {
+		rest += *w
+	}
+	if rest == 0 {
+		rest = 1
+	}
+	for w, p := range probs {
+		if p >= 0 {
+			*w = int(p * scale * float64(rest))
+		}
+	}
+	for _, w := range others {
+		*w = int(float64(*w) * scale * (1 - fixed))
+	}
+}
+
+// pick returns the index of a random choice from ws, with probability
+// proportional to its weight.
+func (f *Fuzzer) pick(ws ...int) int {
+	total := 0
+	for _, w := range ws {
+		total += w
+	}
+	n := f.rand.Intn(total)
+	for i, w := range ws {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	panic("unreachable")
+}